@@ -5,8 +5,12 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/docopt/docopt-go"
+	"io"
 	"math/rand"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 )
@@ -34,9 +38,19 @@ func doit() (err error) {
 		os.Exit(1)
 	}
 
+	verbose := res["-v"].(bool)
+
+	// dispatch cp and sync, which name their own environments
+	if res["cp"].(bool) {
+		return cp(res, verbose)
+	}
+
+	if res["sync"].(bool) {
+		return sync(res, verbose)
+	}
+
 	// load config
 	environment := res["-e"].(string)
-	verbose := res["-v"].(bool)
 
 	conf, err := lib.GetConfig(environment, verbose)
 	if err != nil {
@@ -46,8 +60,18 @@ func doit() (err error) {
 	if conf.Verbose {
 		fmt.Printf("---\n")
 		fmt.Printf("loaded environment '%s'\n", environment)
-		fmt.Printf("using account %s\n", conf.AccountName)
-		fmt.Printf("using container %s\n", conf.Container)
+		if conf.Type == lib.RemoteTypeFilesystem {
+			fmt.Printf("using directory %s\n", conf.Path)
+		} else {
+			fmt.Printf("using account %s\n", conf.AccountName)
+			if conf.BlobEndpoint != "" {
+				fmt.Printf("using endpoint %s\n", conf.BlobEndpoint)
+			}
+			fmt.Printf("using container %s\n", conf.Container)
+			if conf.SASToken != "" {
+				fmt.Printf("using SAS token\n")
+			}
+		}
 	}
 
 	// dispatch images
@@ -63,12 +87,20 @@ func doit() (err error) {
 	// dispatch push
 	if res["push"].(bool) {
 		image := res["<image>"].(string)
+		oci, _ := res["--oci"].(string)
+		expect, _ := res["--expect"].(string)
+
+		if err := setConcurrency(conf, res); err != nil {
+			return err
+		}
+
+		setNoClobber(conf, res)
 
 		if conf.Verbose {
 			fmt.Printf("pushing image '%s'\n", image)
 		}
 
-		push(conf, image)
+		push(conf, image, oci, lib.ID(expect))
 		return nil
 	}
 
@@ -76,25 +108,117 @@ func doit() (err error) {
 	if res["pull"].(bool) {
 
 		image := res["<image>"].(string)
+		oci, _ := res["--oci"].(string)
+
+		if err := setConcurrency(conf, res); err != nil {
+			return err
+		}
 
 		if conf.Verbose {
 			fmt.Printf("pulling image '%s'\n", image)
 		}
 
-		pull(conf, image)
+		pull(conf, image, oci)
 		return nil
 	}
 
 	// dispatch layers
 	if res["layers"].(bool) {
-		fmt.Println("layers is not yet implemented")
-		os.Exit(2)
+		graphviz := res["--graphviz"].(bool)
+
+		if conf.Verbose {
+			fmt.Printf("building layer graph\n")
+		}
+
+		layers(conf, graphviz)
+		return nil
 	}
 
 	// dispatch rmi
 	if res["rmi"].(bool) {
-		fmt.Println("rmi is not yet implemented")
-		os.Exit(2)
+		image := res["<image>"].(string)
+		force := res["--force"].(bool)
+		dryRun := res["--dry-run"].(bool)
+
+		if conf.Verbose {
+			fmt.Printf("removing image '%s'\n", image)
+		}
+
+		rmi(conf, image, force, dryRun)
+		return nil
+	}
+
+	// dispatch gc
+	if res["gc"].(bool) {
+		grace := conf.GCGrace
+		if s, ok := res["--grace"].(string); ok {
+			grace, err = time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+		}
+
+		dryRun := res["--dry-run"].(bool)
+
+		if conf.Verbose {
+			fmt.Printf("collecting garbage older than %v\n", grace)
+		}
+
+		gc(conf, grace, dryRun)
+		return nil
+	}
+
+	// dispatch verify
+	if res["verify"].(bool) {
+		deep := res["--deep"].(bool)
+		repair := res["--repair"].(bool)
+
+		if conf.Verbose {
+			fmt.Printf("verifying remote\n")
+		}
+
+		verify(conf, deep, repair)
+		return nil
+	}
+
+	// dispatch tag
+	if res["tag"].(bool) {
+		src := res["<src>"].(string)
+		dst := res["<dst>"].(string)
+		expect, _ := res["--expect"].(string)
+
+		setNoClobber(conf, res)
+
+		if conf.Verbose {
+			fmt.Printf("tagging image '%s' as '%s'\n", src, dst)
+		}
+
+		tag(conf, src, dst, lib.ID(expect))
+		return nil
+	}
+
+	// dispatch serve
+	if res["serve"].(bool) {
+		addr := res["--listen"].(string)
+
+		if conf.Verbose {
+			fmt.Printf("serving the registry API on %s\n", addr)
+		}
+
+		serve(conf, addr)
+		return nil
+	}
+
+	// dispatch migrate
+	if res["migrate"].(bool) {
+		dryRun := res["--dry-run"].(bool)
+
+		if conf.Verbose {
+			fmt.Printf("migrating remote to the content addressed layout\n")
+		}
+
+		migrate(conf, dryRun)
+		return nil
 	}
 
 	// dispatch tree
@@ -217,23 +341,217 @@ func doit() (err error) {
 	return nil
 }
 
+// copies <src-env>/<image> into <dst-env>[/<image>]
+func cp(res map[string]interface{}, verbose bool) error {
+	srcEnv, image := splitEnvironment(res["<src>"].(string))
+	dstEnv, tag := splitEnvironment(res["<dst>"].(string))
+	if image == "" {
+		return fmt.Errorf("no image in '%s'; expected <environment>/<image>", res["<src>"])
+	}
+
+	srcConf, err := lib.GetConfig(srcEnv, verbose)
+	if err != nil {
+		return err
+	}
+
+	dstConf, err := lib.GetConfig(dstEnv, verbose)
+	if err != nil {
+		return err
+	}
+
+	if err := setConcurrency(dstConf, res); err != nil {
+		return err
+	}
+
+	setNoClobber(dstConf, res)
+
+	if verbose {
+		fmt.Printf("copying image '%s' from '%s' to '%s'\n", image, srcEnv, dstEnv)
+	}
+
+	src, err := lib.NewRemote(srcConf)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	dst, err := lib.NewRemote(dstConf)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	expect, _ := res["--expect"].(string)
+	copied, err := src.Copy(image, dst, tag, lib.ID(expect))
+	if copied != nil {
+		for _, layer := range copied.Layers {
+			fmt.Printf("%s: %s\n", layer.Id.Short(), layer.Status)
+		}
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"image":  image,
+			"reason": err.Error(),
+		}).Error("could not copy image")
+		os.Exit(1)
+	}
+
+	if copied.Present {
+		fmt.Printf("Image %s was already in %s\n", copied.Id.Short(), dstEnv)
+	}
+
+	fmt.Printf("Tagged: %s/%s:%s\n", dstEnv, copied.Repository, copied.Tag)
+	return nil
+}
+
+// replicates the tags of <src-env> matching the patterns into <dst-env>
+func sync(res map[string]interface{}, verbose bool) error {
+	srcEnv := res["<src-env>"].(string)
+	dstEnv := res["<dst-env>"].(string)
+	patterns, _ := res["<pattern>"].([]string)
+	prune := res["--delete"].(bool)
+	dryRun := res["--dry-run"].(bool)
+
+	srcConf, err := lib.GetConfig(srcEnv, verbose)
+	if err != nil {
+		return err
+	}
+
+	dstConf, err := lib.GetConfig(dstEnv, verbose)
+	if err != nil {
+		return err
+	}
+
+	if err := setConcurrency(dstConf, res); err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Printf("syncing '%s' to '%s'\n", srcEnv, dstEnv)
+	}
+
+	src, err := lib.NewRemote(srcConf)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	dst, err := lib.NewRemote(dstConf)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	synced, err := src.Sync(dst, patterns, prune, dryRun)
+	if synced != nil {
+		report := func(done, wouldDo string, refs []string) {
+			for _, ref := range refs {
+				if synced.DryRun {
+					fmt.Printf("%s: %s\n", wouldDo, ref)
+				} else {
+					fmt.Printf("%s: %s\n", done, ref)
+				}
+			}
+		}
+
+		report("Copied", "Would copy", synced.Copied)
+		report("Tagged", "Would tag", synced.Tagged)
+		report("Deleted", "Would delete", synced.Deleted)
+
+		// never in a dry run
+		for _, ref := range synced.Kept {
+			fmt.Printf("Kept, having changed meanwhile: %s\n", ref)
+		}
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if synced.DryRun {
+		fmt.Printf("%d tags to copy, %d to retag, %d to delete, %d unchanged\n",
+			len(synced.Copied), len(synced.Tagged), len(synced.Deleted), synced.Unchanged)
+		return nil
+	}
+
+	fmt.Printf("%d tags copied, %d retagged, %d deleted, %d unchanged; %d layers sent\n",
+		len(synced.Copied), len(synced.Tagged), len(synced.Deleted), synced.Unchanged, synced.Layers)
+	return nil
+}
+
+// splits "<environment>/<image>" at the first slash; the image is optional
+func splitEnvironment(s string) (environment, image string) {
+	if i := strings.Index(s, "/"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+
+	return s, ""
+}
+
+// overrides the environment's concurrency with --concurrency, if given
+func setConcurrency(conf *lib.Config, res map[string]interface{}) error {
+	s, ok := res["--concurrency"].(string)
+	if !ok {
+		return nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid concurrency '%s'", s)
+	}
+
+	conf.Concurrency = n
+	return nil
+}
+
+// refuses to move tags that name another image with --no-clobber, if given
+func setNoClobber(conf *lib.Config, res map[string]interface{}) {
+	if res["--no-clobber"] == true {
+		conf.NoClobber = true
+	}
+}
+
 func usage(argv []string) (map[string]interface{}, error) {
-	usage := `azdockertool - reads and writes Docker images to Azure Blob Storage
+	usage := `azdockertool - reads and writes Docker images to Azure Blob Storage (or a shared directory)
 
 Usage:
   azdockertool [ -v ] [ -e environment ] images
-  azdockertool [ -v ] [ -e environment ] push <image>
-  azdockertool [ -v ] [ -e environment ] pull <image>
+  azdockertool [ -v ] [ -e environment ] push [ --concurrency n ] [ --oci dir ] [ --no-clobber ] [ --expect id ] <image>
+  azdockertool [ -v ] [ -e environment ] pull [ --concurrency n ] [ --oci dir ] <image>
   azdockertool [ -v ] [ -e environment ] layers [ --graphviz ]
-  azdockertool [ -v ] [ -e environment ] rmi <image>
+  azdockertool [ -v ] [ -e environment ] rmi [ --force ] [ --dry-run ] <image>
+  azdockertool [ -v ] [ -e environment ] gc [ --grace duration ] [ --dry-run ]
+  azdockertool [ -v ] [ -e environment ] verify [ --deep ] [ --repair ]
+  azdockertool [ -v ] [ -e environment ] migrate [ --dry-run ]
+  azdockertool [ -v ] [ -e environment ] tag [ --no-clobber ] [ --expect id ] <src> <dst>
+  azdockertool [ -v ] [ -e environment ] serve [ --listen addr ]
+  azdockertool [ -v ] cp [ --concurrency n ] [ --no-clobber ] [ --expect id ] <src> <dst>
+  azdockertool [ -v ] sync [ --concurrency n ] [ --delete ] [ --dry-run ] <src-env> <dst-env> [ <pattern>... ]
   azdockertool -h | --help
   azdockertool --version
 
 Arguments:
   image 			The name of a Docker image; optionally may specify a tag (e.g. docker/helloworld:1.0)
+  src 			An image (tag) or a (partial) image ID; for cp, prefixed by its environment (e.g. dev/docker/helloworld:1.0)
+  dst 			What to tag the image as; for cp, prefixed by its environment, and optional (e.g. prod/helloworld:stable)
+  pattern 		A glob matching repositories to sync (e.g. team/*); all of them if none are given
 
 Options:
-  -e environment    Specifies the Azure Storage Services account to use [default: default]
+  -e environment    Specifies the environment (storage account or directory) to use [default: default]
+  --force        	Remove an image ID even if it is still tagged (rmi)
+  --dry-run      	List the blobs (or tags) that would be deleted (or copied), but don't change anything
+  --grace duration	Leave unreferenced blobs newer than this alone (gc); e.g. 6h
+  --deep         	Also re-hash image configs and layers (verify)
+  --repair       	Delete tags that point at missing images (verify)
+  --concurrency n	How many layers, blocks or ranges to transfer at once (push, pull, cp, sync); push sends layers one by one, as they're exported
+  --delete       	Also delete tags the destination has that the source doesn't (sync)
+  --no-clobber   	Refuse to move a tag that already names another image (push, tag, cp)
+  --expect id    	Move the tag only if it names this (partial) image ID now (push, tag, cp)
+  --oci dir      	Read (push) or write (pull) an OCI image layout instead of using Docker
+  --listen addr  	Where to serve the registry API (serve); it has no authentication, so
+                 	listen beyond localhost only behind a proxy that adds some [default: 127.0.0.1:5000]
   -h, --help     	Show this screen.
   --version     	Show version.
 
@@ -241,6 +559,15 @@ The most commonly used commands are:
    images      	Lists remote images
    pull			Retrieves an image from storage
    push			Publishes an image to storage
+   layers		Shows how remote images share layers (or emits DOT with --graphviz)
+   rmi			Untags an image and deletes whatever is no longer referenced
+   gc			Deletes images and layers that no tag refers to; best run while nothing is pushing
+   verify		Checks that every tag, image and layer is complete
+   migrate		Rewrites legacy images into the content addressed layout
+   tag			Tags a remote image again, without pushing it
+   serve		Serves the remote over the Docker Registry API (v2), for docker pull and push
+   cp			Copies an image between environments, optionally retagging it
+   sync			Copies the tags of an environment that another is missing
 
 Environment configurations are loaded from ~/.azdockertool.toml.
 `
@@ -258,7 +585,7 @@ Environment configurations are loaded from ~/.azdockertool.toml.
 
 // lists remote images
 func images(config *lib.Config) {
-	remote, err := lib.NewAzureBlobStorageRemote(config)
+	remote, err := lib.NewRemote(config)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -285,36 +612,234 @@ func images(config *lib.Config) {
 	}
 }
 
-// exports a local image:tag to Azure Blob Storage
-func push(config *lib.Config, image string) {
-	client, err := lib.NewDockerClient(config)
+// prints the remote layer graph as a tree, or as DOT for graphviz
+func layers(config *lib.Config, graphviz bool) {
+	remote, err := lib.NewRemote(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	graph, err := remote.Graph()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if graphviz {
+		err = graph.WriteGraphviz(os.Stdout)
+	} else {
+		err = graph.WriteTree(os.Stdout)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// untags and deletes a remote image
+func rmi(config *lib.Config, image string, force, dryRun bool) {
+	remote, err := lib.NewRemote(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	res, err := remote.Rmi(image, force, dryRun)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, tag := range res.Untagged {
+		fmt.Printf("Untagged: %s\n", tag)
+	}
+
+	for _, name := range res.Deleted {
+		if res.DryRun {
+			fmt.Printf("Would delete: %s\n", name)
+		} else {
+			fmt.Printf("Deleted: %s\n", name)
+		}
+	}
+}
+
+// deletes unreferenced images and layers
+func gc(config *lib.Config, grace time.Duration, dryRun bool) {
+	remote, err := lib.NewRemote(config)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	exporter := func(dir, repository string) error {
-		return lib.DockerSave(client, repository, dir)
+	res, err := remote.GC(grace, dryRun)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, name := range res.Deleted {
+		if res.DryRun {
+			fmt.Printf("Would delete: %s\n", name)
+		} else {
+			fmt.Printf("Deleted: %s\n", name)
+		}
+	}
+
+	if config.Verbose {
+		for _, name := range res.Retained {
+			fmt.Printf("Retained (within grace period): %s\n", name)
+		}
 	}
 
-	remote, err := lib.NewAzureBlobStorageRemote(config)
+	fmt.Printf("%d images and %d layers in use; %d blobs unreferenced, %d within the grace period\n",
+		res.MarkedImages, res.MarkedLayers, len(res.Deleted), len(res.Retained))
+}
+
+// audits the remote, exiting non-zero if anything is wrong with it
+func verify(config *lib.Config, deep, repair bool) {
+	remote, err := lib.NewRemote(config)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	// figure out where to stage the uploads
-	localStorage, err := lib.NewLocalStorage()
+	res, err := remote.Verify(deep, repair)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	// FIXME: Uncomment before using a lot.
-	//defer localStorage.Dispose()
+	if len(res.Problems) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+		fmt.Fprintf(w, "PROBLEM\tBLOB\tDETAIL\tREPAIRED\n")
+
+		for _, p := range res.Problems {
+			repaired := ""
+			if p.Repaired {
+				repaired = "yes"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Kind, p.Name, p.Detail, repaired)
+		}
+
+		w.Flush()
+	}
+
+	fmt.Printf("checked %d refs, %d images and %d layers; %d problems\n",
+		res.Refs, res.Images, res.Layers, len(res.Problems))
+
+	if res.Failed() {
+		os.Exit(1)
+	}
+}
+
+// rewrites the remote's legacy images into blobs/sha256/
+func migrate(config *lib.Config, dryRun bool) {
+	remote, err := lib.NewRemote(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	res, err := remote.Migrate(dryRun)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for _, id := range res.Images {
+		if res.DryRun {
+			fmt.Printf("Would migrate: %s\n", id.Short())
+		} else {
+			fmt.Printf("Migrated: %s\n", id.Short())
+		}
+	}
+
+	for _, name := range res.Deleted {
+		if res.DryRun {
+			fmt.Printf("Would delete: %s\n", name)
+		} else {
+			fmt.Printf("Deleted: %s\n", name)
+		}
+	}
+
+	fmt.Printf("%d images and %d layers migrated\n", len(res.Images), len(res.Layers))
+
+	if config.Layout != lib.LayoutCAS {
+		fmt.Printf("set layout = \"%s\" for this environment so that pushes use it too\n", lib.LayoutCAS)
+	}
+}
+
+// tags a remote image (by tag or partial image ID) as another image:tag
+func tag(config *lib.Config, src, dst string, expect lib.ID) {
+	remote, err := lib.NewRemote(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	id, err := remote.Tag(src, dst, expect)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Tagged: %s as %s\n", id.Short(), dst)
+}
+
+// serves the remote to `docker pull` and `docker push` until killed
+func serve(config *lib.Config, addr string) {
+	remote, err := lib.NewRemote(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Serving the registry API on %s\n", addr)
+
+	err = http.ListenAndServe(addr, lib.NewRegistryHandler(remote))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// exports a local image:tag (or one from an OCI image layout) to the remote,
+// reporting what became of each layer
+func push(config *lib.Config, image, oci string, expect lib.ID) {
+	exporter := func(repository string, w io.Writer) error {
+		return lib.OCISave(oci, repository, w)
+	}
+
+	if oci == "" {
+		client, err := lib.NewDockerClient(config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		exporter = func(repository string, w io.Writer) error {
+			return lib.DockerSave(client, repository, w)
+		}
+	}
+
+	remote, err := lib.NewRemote(config)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// upload the missing layers straight from the export
+	pushed, err := remote.Push(image, exporter, expect)
+	if pushed != nil {
+		for _, layer := range pushed.Layers {
+			fmt.Printf("%s: %s\n", layer.Id.Short(), layer.Status)
+		}
+	}
 
-	// upload the individual layers to Azure blob Storage
-	_, err = remote.Push(image, exporter, localStorage)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"image":  image,
@@ -326,7 +851,12 @@ func push(config *lib.Config, image string) {
 }
 
 // pulls a remote image:tag into the local Docker daemon
-func pull(config *lib.Config, image string) {
+func pull(config *lib.Config, image, oci string) {
+	if oci != "" {
+		pullOCI(config, image, oci)
+		return
+	}
+
 	client, err := lib.NewDockerClient(config)
 	if err != nil {
 		fmt.Println(err)
@@ -336,45 +866,70 @@ func pull(config *lib.Config, image string) {
 	// nautical!
 	skipper := func(id lib.ID) (bool, error) {
 		ok, err := lib.DockerImageExists(client, id)
-		if ok && err != nil {
-			fmt.Printf("Docker host already has id '%s', stop scanning.\n", id.Short())
+		if ok && err == nil {
+			fmt.Printf("Docker host already has id '%s', skipping download.\n", id.Short())
 		}
 
 		return ok, err
 	}
 
-	remote, err := lib.NewAzureBlobStorageRemote(config)
+	remote, err := lib.NewRemote(config)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	// figure out where to put the downloads
-	localStorage, err := lib.NewLocalStorage()
+	// loads the image into the Docker host as it downloads
+	importer := func(r io.Reader) error {
+		// Seriously; the original code has a "placebo" progress bar.
+		fmt.Println("Please be patient, this may take a while.  Instead of treating you like a child and showing a fake progress bar, we're just asking you to chill.")
+
+		return lib.DockerLoad(client, r)
+	}
+
+	res, err := remote.Pull(image, skipper, importer)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	// FIXME: Uncomment before using a lot.
-	//defer localStorage.Dispose()
+	if res.Present {
+		if res.Repository != "" {
+			err = lib.DockerTag(client, res.Id, res.Repository, res.Tag)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		return
+	}
+
+	fmt.Printf("Imported image(%s) into docker host\n", res.Id.Short())
+}
 
-	res, err := remote.Pull(image, skipper, localStorage)
+// pulls a remote image:tag into an OCI image layout
+func pullOCI(config *lib.Config, image, oci string) {
+	remote, err := lib.NewRemote(config)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	//fmt.Println("Go debug this in bash and see if it works first")
-
-	fmt.Printf("Importing image(%s) TAR file to docker host\n", res.Id.Short())
+	// the layout's index.json is rewritten either way
+	skipper := func(id lib.ID) (bool, error) {
+		return false, nil
+	}
 
-	// Seriously; the original code has a "placebo" progress bar.
-	fmt.Println("Please be patient, this may take a while.  Instead of treating you like a child and showing a fake progress bar, we're just asking you to chill.")
+	importer := func(r io.Reader) error {
+		return lib.OCILoad(oci, r)
+	}
 
-	err = lib.DockerLoad(client, res.Src)
+	res, err := remote.Pull(image, skipper, importer)
 	if err != nil {
 		fmt.Println(err)
-		return
+		os.Exit(1)
 	}
+
+	fmt.Printf("Wrote image(%s) to %s\n", res.Id.Short(), oci)
 }
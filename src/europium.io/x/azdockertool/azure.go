@@ -1,17 +1,23 @@
 package azdockertool
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	sdk "github.com/Azure/azure-sdk-for-go/storage"
 	log "github.com/Sirupsen/logrus"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -19,112 +25,508 @@ var (
 	ErrMultipleResults  error = errors.New("multiple results found; try to narrow down your query")
 	ErrTooLargeToCommit error = errors.New("did not commit upload because it is too large (> 1 TiB)")
 	ErrFileNotFound     error = errors.New("file not found")
+	ErrIncompleteLayer  error = errors.New("corrupt or incomplete layer encountered")
 )
 
 const (
 	MaxBlobBlockSize = 4 * 1024 * 1024 // 4 MiB
 	MaxBlobBlockId   = 262144          // 262144 * 4 MiB = 1 TiB
+
+	azureDateLayout string = time.RFC1123
+
+	// base64; stands in for the account key when authenticating with a SAS token
+	sasPlaceholderKey string = "c2FzLXRva2Vu"
 )
 
+var (
+	// SAS permission letters
+	permissionNames = map[rune]string{
+		'r': "read",
+		'a': "add",
+		'c': "create",
+		'w': "write",
+		'd': "delete",
+		'l': "list",
+	}
+)
+
+// absremote keeps the container structure in Azure Blob Storage
 type absremote struct {
+	*layout
 	config      *Config
+	container   string // as addressed by the SDK; see newAzureClient
+	host        string // that path-style requests are redirected to, if any
 	client      sdk.Client
 	blobStorage sdk.BlobStorageClient
 }
 
 // Returns an Azure Blob Storage backend
 func NewAzureBlobStorageRemote(config *Config) (Remote, error) {
-	client, err := sdk.NewBasicClient(config.AccountName, config.AccountKey)
+	client, container, host, err := newAzureClient(config)
 	if err != nil {
 		return nil, err
 	}
 
 	remote := &absremote{
 		config:      config,
+		container:   container,
+		host:        host,
 		client:      client,
 		blobStorage: client.GetBlobService(),
 	}
 
+	remote.layout = &layout{config, remote}
+
 	return remote, nil
 }
 
-// Retrieves a file from Azure Blob Storage and interprets it as a string
-func (ar *absremote) GetBlobAsString(path string) (string, error) {
-	f, err := ar.blobStorage.GetBlob(ar.config.Container, path)
+// Builds a storage client for the configured endpoint and credentials.
+//
+// The SDK only knows how to address {account}.blob.{suffix}. Endpoints of that
+// form (sovereign clouds, custom suffixes) are handled natively. Anything else
+// (Azurite, other local stand-ins) is path-style: the endpoint's path is
+// prepended to the container, so that requests are signed over the right
+// resource, and the request is redirected to the endpoint's host.
+//
+// The SDK also insists on signing every request with an account key, so with
+// a SAS token it's given a placeholder key and the signature is swapped for
+// the token on the way out.
+//
+// Returns the client, the container as the SDK should address it, and the
+// host that requests are redirected to (empty if they aren't).
+func newAzureClient(config *Config) (sdk.Client, string, string, error) {
+	account := config.AccountName
+	key := config.AccountKey
+	if config.SASToken != "" {
+		key = sasPlaceholderKey
+	}
+
+	var transport http.RoundTripper = http.DefaultTransport
+	if config.SASToken != "" {
+		sas, err := url.ParseQuery(config.SASToken)
+		if err != nil || sas.Get("sig") == "" {
+			return sdk.Client{}, "", "", errors.New("invalid SAS token; expected something like 'sv=...&sp=rl&sig=...'")
+		}
+
+		transport = &sasTransport{sas: sas, next: transport}
+	}
+
+	useHTTPS := config.UseHTTPS
+	suffix := firstNonEmpty(config.EndpointSuffix, sdk.DefaultBaseURL)
+	container := config.Container
+	host := ""
+
+	if config.BlobEndpoint != "" {
+		endpoint, err := url.Parse(config.BlobEndpoint)
+		if err != nil || endpoint.Host == "" {
+			return sdk.Client{}, "", "", fmt.Errorf("invalid blob endpoint '%s'", config.BlobEndpoint)
+		}
+
+		useHTTPS = endpoint.Scheme == "https"
+		path := strings.Trim(endpoint.Path, "/")
+
+		// a SAS connection string names the endpoint, not the account
+		if i := strings.Index(endpoint.Host, ".blob."); account == "" && i > 0 {
+			account = endpoint.Host[:i]
+		}
+
+		hostPrefix := account + ".blob."
+		if strings.HasPrefix(endpoint.Host, hostPrefix) && path == "" {
+			// host-style, e.g. https://myaccount.blob.core.chinacloudapi.cn
+			suffix = strings.TrimPrefix(endpoint.Host, hostPrefix)
+		} else {
+			// path-style, e.g. http://127.0.0.1:10000/devstoreaccount1
+			suffix = endpoint.Host
+			host = endpoint.Host
+			transport = &endpointTransport{host: endpoint.Host, next: transport}
+			if path != "" {
+				container = path + "/" + container
+			}
+		}
+	}
+
+	client, err := sdk.NewClient(account, key, suffix, sdk.DefaultAPIVersion, useHTTPS)
 	if err != nil {
-		return "", err
+		return client, "", "", err
 	}
 
-	defer f.Close()
+	if transport != http.DefaultTransport {
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
 
-	// Read until null terminator
-	buf := bufio.NewReader(f)
-	ys, err := buf.ReadBytes(0)
-	if err != nil && err != io.EOF {
-		return "", err
+	return client, container, host, nil
+}
+
+// endpointTransport sends every request to a fixed host, leaving the path alone
+type endpointTransport struct {
+	host string
+	next http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.Host = t.host
+
+	r := *req
+	r.URL = &u
+	r.Host = t.host
+
+	return t.next.RoundTrip(&r)
+}
+
+// sasTransport authenticates requests with a SAS token instead of a shared key
+type sasTransport struct {
+	sas  url.Values
+	next http.RoundTripper
+}
+
+func (t *sasTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	q := u.Query()
+	for k, v := range t.sas {
+		q[k] = v
 	}
+	u.RawQuery = q.Encode()
 
-	if err == io.EOF {
-		return string(ys), nil
+	header := make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		if k != "Authorization" {
+			header[k] = v
+		}
 	}
 
-	// Don't return the null terminator
-	return string(ys[:len(ys)-1]), nil
+	r := *req
+	r.URL = &u
+	r.Header = header
+
+	return t.next.RoundTrip(&r)
 }
 
-// Downloads all blobs sharing a given prefix to the given dir
-func (ar *absremote) fetchAll(srcDir, dstDir string) (n int, err error) {
-	res, err := ar.blobStorage.ListBlobs(ar.config.Container, sdk.ListBlobsParameters{Prefix: srcDir})
+// Fails early if the credentials can't possibly allow an operation; with an
+// account key anything goes, while a SAS token lists what it grants in 'sp'
+func (ar *absremote) requirePermissions(op, perms string) error {
+	if ar.config.SASToken == "" {
+		return nil
+	}
+
+	sas, err := url.ParseQuery(ar.config.SASToken)
 	if err != nil {
-		return 0, fmt.Errorf("remote unavailable: %s", err)
+		return err
 	}
 
-	if err := os.MkdirAll(dstDir, os.ModeDir|0700); err != nil {
-		return 0, err
+	// permissions may live in a stored access policy instead; let the service decide
+	granted := sas.Get("sp")
+	if granted == "" {
+		return nil
 	}
 
-	if ar.config.Verbose {
-		fmt.Printf("fetching %d blobs to '%s'...\n", len(res.Blobs), dstDir)
+	var missing []string
+	for _, p := range perms {
+		if !strings.ContainsRune(granted, p) {
+			missing = append(missing, permissionNames[p])
+		}
 	}
 
-	n = 0
-	for _, item := range res.Blobs {
-		err = ar.fetch(item.Name, dstDir)
+	if len(missing) > 0 {
+		return &PermissionError{Op: op, Missing: missing, Granted: granted}
+	}
+
+	return nil
+}
+
+// Lists every blob sharing a prefix
+func (ar *absremote) listBlobs(prefix string) ([]blobInfo, error) {
+	var coll []blobInfo
+
+	it := newBlobIterator(ar.blobStorage, ar.container, prefix, ar.config.Retry)
+	for it.Next() {
+		coll = append(coll, toBlobInfo(it.Blob()))
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("remote unavailable: %s", err)
+	}
+
+	return coll, nil
+}
+
+// blobIterator walks a listing one blob at a time, following continuation
+// markers; a single List Blobs call returns at most 5000 blobs
+type blobIterator struct {
+	client    sdk.BlobStorageClient
+	container string
+	params    sdk.ListBlobsParameters
+	retry     RetryPolicy
+
+	page []sdk.Blob
+	cur  sdk.Blob
+	err  error
+	done bool
+}
+
+func newBlobIterator(client sdk.BlobStorageClient, container, prefix string, retry RetryPolicy) *blobIterator {
+	return &blobIterator{
+		client:    client,
+		container: container,
+		params:    sdk.ListBlobsParameters{Prefix: prefix},
+		retry:     retry,
+	}
+}
+
+// Advances to the next blob, fetching the next page if need be; returns false
+// once the listing is exhausted or has failed
+func (it *blobIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+
+		var res sdk.BlobListResponse
+		err := it.retry.do("ListBlobs", it.params.Prefix, func() (err error) {
+			res, err = it.client.ListBlobs(it.container, it.params)
+			return err
+		})
+
 		if err != nil {
-			return n, err
+			it.err = err
+			return false
 		}
 
-		n++
+		it.page = res.Blobs
+		it.params.Marker = res.NextMarker
+		it.done = res.NextMarker == ""
 	}
 
-	return n, nil
+	it.cur, it.page = it.page[0], it.page[1:]
+	return true
 }
 
-// Downloads a single blob to the given dir
-func (ar *absremote) fetch(srcPath, dstDir string) error {
-	src, err := ar.blobStorage.GetBlob(ar.config.Container, srcPath)
-	if err != nil {
-		return fmt.Errorf("could not download '%s': %v\n", srcPath, err)
+// Returns the current blob
+func (it *blobIterator) Blob() sdk.Blob {
+	return it.cur
+}
+
+// Returns the error that stopped the listing, if any
+func (it *blobIterator) Err() error {
+	return it.err
+}
+
+// Opens a blob for reading
+func (ar *absremote) openBlob(name string) (io.ReadCloser, error) {
+	var f io.ReadCloser
+	err := ar.config.Retry.do("GetBlob", name, func() (err error) {
+		f, err = ar.blobStorage.GetBlob(ar.container, name)
+		return err
+	})
+
+	if isAzureNotFound(err) {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &retryingReader{ar: ar, name: name, body: f}, nil
+}
+
+// Opens part of a blob for reading
+func (ar *absremote) openBlobRange(name string, offset, length int64) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := ar.config.Retry.do("GetBlobRange", name, func() (err error) {
+		r, err = ar.blobStorage.GetBlobRange(ar.container, name, fmt.Sprintf("%d-%d", offset, offset+length-1))
+		return err
+	})
+
+	if isAzureNotFound(err) {
+		return nil, ErrBlobNotFound
+	}
+
+	return r, err
+}
+
+// Uploads a blob, block by block if need be
+func (ar *absremote) putBlob(name string, r io.Reader) error {
+	return putBlockBlob(ar.blobStorage, ar.container, name, r, MaxBlobBlockSize, ar.config.Concurrency, ar.config.Retry)
+}
+
+// Copies a blob within the container, server-side; its metadata goes with it
+func (ar *absremote) copyBlob(src, dst string) error {
+	source := ar.blobURL(src)
+	return ar.config.Retry.do("CopyBlob", dst, func() error {
+		return ar.blobStorage.CopyBlob(ar.container, dst, source)
+	})
+}
+
+// Copies a blob from another container under the same name, server-side, if
+// the service can read it there: it carries a SAS token, or it's in the same
+// account and this one is authorized by account key
+func (ar *absremote) copyRemoteBlob(src blobstore, name string) (bool, error) {
+	from, ok := src.(*absremote)
+	if !ok {
+		return false, nil
 	}
 
-	defer src.Close()
+	sameAccount := from.config.AccountName == ar.config.AccountName && ar.config.SASToken == ""
+	if from.config.SASToken == "" && !sameAccount {
+		return false, nil
+	}
+
+	source := from.blobURL(name)
+	return true, ar.config.Retry.do("CopyBlob", name, func() error {
+		return ar.blobStorage.CopyBlob(ar.container, name, source)
+	})
+}
+
+// Reads a blob and its ETag. The ETag is read first, so that a blob changed
+// in between fails the write that's conditional on it, rather than being
+// overwritten.
+func (ar *absremote) getBlobETag(name string) ([]byte, string, error) {
+	var props *sdk.BlobProperties
+	err := ar.config.Retry.do("GetBlobProperties", name, func() (err error) {
+		props, err = ar.blobStorage.GetBlobProperties(ar.container, name)
+		return err
+	})
 
-	ns := strings.Split(srcPath, "/")
-	name := ns[len(ns)-1]
+	if isAzureNotFound(err) {
+		return nil, "", ErrBlobNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
 
-	dst, err := os.Create(filepath.Join(dstDir, name))
+	f, err := ar.openBlob(name)
 	if err != nil {
+		return nil, "", err
+	}
+
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	return b, props.Etag, err
+}
+
+// Writes a small blob in one request, conditional on its ETag
+func (ar *absremote) putBlobIfMatch(name string, b []byte, etag string) error {
+	headers := map[string]string{"If-None-Match": "*"}
+	if etag != "" {
+		headers = map[string]string{"If-Match": etag}
+	}
+
+	err := ar.config.Retry.do("PutBlob", name, func() error {
+		return ar.blobStorage.CreateBlockBlobFromReader(ar.container, name, uint64(len(b)), bytes.NewReader(b), headers)
+	})
+
+	// 409 (BlobAlreadyExists) for If-None-Match, 412 for If-Match
+	if isAzureStatus(err, http.StatusConflict) || isAzureStatus(err, http.StatusPreconditionFailed) {
+		return errPreconditionFailed
+	}
+
+	return err
+}
+
+// Deletes a blob, conditional on its ETag
+func (ar *absremote) deleteBlobIfMatch(name, etag string) error {
+	err := ar.config.Retry.do("DeleteBlob", name, func() error {
+		_, err := ar.blobStorage.DeleteBlobIfExists(ar.container, name, map[string]string{"If-Match": etag})
 		return err
+	})
+
+	if isAzureStatus(err, http.StatusPreconditionFailed) {
+		return errPreconditionFailed
 	}
 
-	defer dst.Close()
+	return err
+}
 
-	_, err = io.Copy(dst, src)
+// Returns the URL of a blob, as the service needs it to be given as the
+// source of a copy: at the host requests really go to, and carrying the SAS
+// token if that's what authorizes them
+func (ar *absremote) blobURL(name string) string {
+	u, err := url.Parse(ar.blobStorage.GetBlobURL(ar.container, name))
 	if err != nil {
+		return ar.blobStorage.GetBlobURL(ar.container, name)
+	}
+
+	if ar.host != "" {
+		u.Host = ar.host
+	}
+
+	if ar.config.SASToken != "" {
+		u.RawQuery = ar.config.SASToken
+	}
+
+	return u.String()
+}
+
+// Reads a blob's metadata
+func (ar *absremote) getBlobMetadata(name string) (map[string]string, error) {
+	var meta map[string]string
+	err := ar.config.Retry.do("GetBlobMetadata", name, func() (err error) {
+		meta, err = ar.blobStorage.GetBlobMetadata(ar.container, name)
 		return err
+	})
+
+	if isAzureNotFound(err) {
+		return nil, ErrBlobNotFound
 	}
 
-	return nil
+	return meta, err
+}
+
+// Replaces a blob's metadata
+func (ar *absremote) setBlobMetadata(name string, meta map[string]string) error {
+	return ar.config.Retry.do("SetBlobMetadata", name, func() error {
+		return ar.blobStorage.SetBlobMetadata(ar.container, name, meta)
+	})
+}
+
+// Deletes a blob, if it exists
+func (ar *absremote) deleteBlob(name string) error {
+	return ar.config.Retry.do("DeleteBlob", name, func() error {
+		_, err := ar.blobStorage.DeleteBlobIfExists(ar.container, name, nil)
+		return err
+	})
+}
+
+func toBlobInfo(item sdk.Blob) blobInfo {
+	info := blobInfo{
+		Name:       item.Name,
+		Size:       item.Properties.ContentLength,
+		ContentMD5: item.Properties.ContentMD5,
+	}
+
+	modified, err := time.Parse(azureDateLayout, item.Properties.LastModified)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":         item.Name,
+			"LastModified": item.Properties.LastModified,
+		}).Warn("malformed last modified")
+	} else {
+		info.LastModified = modified
+	}
+
+	return info
+}
+
+// Returns whether an error from the storage service means the blob doesn't exist
+func isAzureNotFound(err error) bool {
+	return isAzureStatus(err, http.StatusNotFound)
+}
+
+// Returns whether an error from the storage service has the given status
+func isAzureStatus(err error, code int) bool {
+	if e, ok := err.(sdk.AzureStorageServiceError); ok {
+		return e.StatusCode == code
+	}
+
+	if e, ok := err.(sdk.UnexpectedStatusCodeError); ok {
+		return e.Got() == code
+	}
+
+	// as HEAD requests fail
+	if m := bodylessStatus.FindStringSubmatch(fmt.Sprint(err)); m != nil {
+		return m[1] == strconv.Itoa(code)
+	}
+
+	return false
 }
 
 // Sends a file to Azure Blob Storage
@@ -140,96 +542,272 @@ func PutBlockBlobFromFile(client sdk.BlobStorageClient, container, name, path st
 
 	defer f.Close()
 
-	return putBlockBlob(client, container, name, f, MaxBlobBlockSize)
+	return putBlockBlob(client, container, name, f, MaxBlobBlockSize, 1, DefaultRetryPolicy())
 }
 
-func putBlockBlob(client sdk.BlobStorageClient, container, name string, blob io.Reader, chunkSize int) error {
+// Uploads a blob in blocks of up to chunkSize bytes, sending up to concurrency
+// blocks at once; blobs that fit into a single block are sent in one request.
+//
+// Blocks are named after their offset and contents, so blocks an interrupted
+// upload of the same blob left uncommitted are recognised and not sent again.
+func putBlockBlob(client sdk.BlobStorageClient, container, name string, blob io.Reader, chunkSize, concurrency int, retry RetryPolicy) error {
 	if chunkSize <= 0 || chunkSize > MaxBlobBlockSize {
 		chunkSize = MaxBlobBlockSize
 	}
 
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
 	chunk := make([]byte, chunkSize)
-	n, err := blob.Read(chunk)
-	if err != nil && err != io.EOF {
+	n, err := io.ReadFull(blob, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Fits into one block
+		return putSingleBlockBlob(client, container, name, chunk[:n], retry)
+	} else if err != nil {
 		return err
 	}
 
-	if err == io.EOF {
-		// Fits into one block
-		return putSingleBlockBlob(client, container, name, chunk[:n])
-	} else {
-		// Does not fit into one block. Upload block by block then commit the block list
-		blockList := []sdk.Block{}
-
-		// Put blocks
-		for blockNum := 0; blockNum < MaxBlobBlockId; blockNum++ {
-			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%07d", blockNum)))
-			data := chunk[:n]
-			err = client.PutBlock(container, name, id, data)
-			if err != nil {
-				return err // todo(politician): retries
-			}
+	// Does not fit into one block. Upload block by block then commit the block list
+	uploaded, err := uncommittedBlocks(client, container, name, retry)
+	if err != nil {
+		return err
+	}
 
-			blockList = append(blockList, sdk.Block{id, sdk.BlockStatusLatest})
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
 
-			// Read next block
-			n, err = blob.Read(chunk)
-			if err != nil && err != io.EOF {
-				return err
-			}
-			if err == io.EOF {
-				break
-			}
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
 
-			if blockNum%10 == 0 {
-				log.WithFields(log.Fields{
-					"blocks": blockNum + 1,
-					"MiB":    uint(blockNum+1) * uint(MaxBlobBlockSize),
-				}).Info("progress")
-			}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	// each block in flight holds a buffer; taking one from the pool bounds the
+	// number of blocks in flight (and the memory they use)
+	buffers := make(chan []byte, concurrency)
+	for i := 1; i < concurrency; i++ {
+		buffers <- nil
+	}
+
+	blockList := []sdk.Block{}
+	reused := 0
+
+	// Put blocks
+	var offset int64
+	for blockNum := 0; ; blockNum++ {
+		if blockNum == MaxBlobBlockId {
+			fail(ErrTooLargeToCommit) // max block id exceeded
+			buffers <- chunk
+			break
 		}
 
-		if _, err := blob.Read(chunk); err != io.EOF {
-			return ErrTooLargeToCommit // max block id exceeded
+		id := blockId(offset, chunk[:n])
+		blockList = append(blockList, sdk.Block{ID: id, Status: sdk.BlockStatusLatest})
+		offset += int64(n)
+
+		if size, ok := uploaded[id]; ok && size == int64(n) {
+			// left behind by an earlier attempt
+			reused++
+			buffers <- chunk
+		} else {
+			wg.Add(1)
+			go func(id string, chunk []byte, n int) {
+				defer wg.Done()
+				defer func() { buffers <- chunk }()
+
+				if failed() {
+					return
+				}
+
+				// the service checks each block against its Content-MD5
+				headers := map[string]string{"Content-MD5": contentMD5(chunk[:n])}
+				err := retry.do("PutBlock", name, func() error {
+					return client.PutBlockWithLength(container, name, id, uint64(n), bytes.NewReader(chunk[:n]), headers)
+				})
+
+				if err != nil {
+					fail(err)
+				}
+			}(id, chunk, n)
 		}
 
-		log.WithFields(log.Fields{
-			"name":   name,
-			"blocks": len(blockList),
-		}).Info("committing block list")
+		if blockNum%10 == 0 {
+			log.WithFields(log.Fields{
+				"blocks": blockNum + 1,
+				"MiB":    uint(blockNum+1) * uint(chunkSize) >> 20,
+			}).Info("progress")
+		}
 
-		// Commit block list
-		return client.PutBlockList(container, name, blockList)
+		if err == io.ErrUnexpectedEOF {
+			break // that was the last, partial block
+		}
+
+		// Read next block
+		chunk = <-buffers
+		if chunk == nil {
+			chunk = make([]byte, chunkSize)
+		}
+
+		if failed() {
+			buffers <- chunk
+			break
+		}
+
+		n, err = io.ReadFull(blob, chunk)
+		if err == io.EOF {
+			buffers <- chunk
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			fail(err)
+			buffers <- chunk
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
 	}
+
+	log.WithFields(log.Fields{
+		"name":   name,
+		"blocks": len(blockList),
+		"reused": reused,
+	}).Info("committing block list")
+
+	// Commit block list
+	return retry.do("PutBlockList", name, func() error {
+		return client.PutBlockList(container, name, blockList)
+	})
 }
 
-func putSingleBlockBlob(client sdk.BlobStorageClient, container, name string, chunk []byte) error {
-	if len(chunk) > MaxBlobBlockSize {
-		return fmt.Errorf("storage: provided chunk (%d bytes) cannot fit into single-block blob (max %d bytes)", len(chunk), MaxBlobBlockSize)
+// Names a block after where it goes and what's in it; every id has the same
+// length, as Azure requires of the blocks of a blob
+func blockId(offset int64, chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%016x-%x", offset, sum[:16])))
+}
+
+// Returns the sizes of the blocks uploaded to a blob but never committed, by
+// id. Blocks named some other way (by an older version) can't be reused and
+// would make Azure reject ours, so they're discarded.
+func uncommittedBlocks(client sdk.BlobStorageClient, container, name string, retry RetryPolicy) (map[string]int64, error) {
+	var res sdk.BlockListResponse
+	err := retry.do("GetBlockList", name, func() (err error) {
+		res, err = client.GetBlockList(container, name, sdk.BlockListTypeUncommitted)
+		return err
+	})
+
+	blocks := make(map[string]int64)
+	if isAzureNotFound(err) {
+		return blocks, nil
+	} else if err != nil {
+		return nil, err
 	}
 
-	size := uint64(len(chunk))
-	r := bytes.NewReader(chunk)
-	extraHeaders := make(map[string]string)
+	idLength := len(blockId(0, nil))
+	for _, item := range res.UncommittedBlocks {
+		if len(item.Name) != idLength {
+			return blocks, discardUncommittedBlocks(client, container, name, retry)
+		}
+
+		blocks[item.Name] = item.Size
+	}
+
+	if len(blocks) > 0 {
+		log.WithFields(log.Fields{
+			"name":   name,
+			"blocks": len(blocks),
+		}).Info("resuming upload")
+	}
 
-	return client.CreateBlockBlobFromReader(container, name, size, r, extraHeaders)
+	return blocks, nil
 }
 
-// Returns whether or not the remote contains a particular layer
-func (ar *absremote) HasLayer(id ID) (bool, error) {
-	path := fmt.Sprintf("layers/%s", id.String())
+// Throws away a blob's uncommitted blocks, which only committing a block list
+// does; the blob is then deleted unless it already existed. Committing resets
+// the blob's metadata (the digest recorded with it), so that's put back.
+func discardUncommittedBlocks(client sdk.BlobStorageClient, container, name string, retry RetryPolicy) error {
+	log.WithFields(log.Fields{
+		"name": name,
+	}).Warn("discarding blocks of an earlier upload")
+
+	var committed sdk.BlockListResponse
+	err := retry.do("GetBlockList", name, func() (err error) {
+		committed, err = client.GetBlockList(container, name, sdk.BlockListTypeCommitted)
+		return err
+	})
+
+	if err != nil && !isAzureNotFound(err) {
+		return err
+	}
+
+	var blockList []sdk.Block
+	for _, item := range committed.CommittedBlocks {
+		blockList = append(blockList, sdk.Block{ID: item.Name, Status: sdk.BlockStatusCommitted})
+	}
+
+	var meta map[string]string
+	if len(blockList) > 0 {
+		err = retry.do("GetBlobMetadata", name, func() (err error) {
+			meta, err = client.GetBlobMetadata(container, name)
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = retry.do("PutBlockList", name, func() error {
+		return client.PutBlockList(container, name, blockList)
+	})
 
-	// using ListBlobs because each layer should contain 3 blobs
-	res, err := ar.blobStorage.ListBlobs(ar.config.Container, sdk.ListBlobsParameters{Prefix: path})
 	if err != nil {
-		return false, fmt.Errorf("remote unavailable: %s", err)
+		return err
+	} else if len(blockList) == 0 {
+		return retry.do("DeleteBlob", name, func() error {
+			_, err := client.DeleteBlobIfExists(container, name, nil)
+			return err
+		})
+	} else if len(meta) == 0 {
+		return nil
 	}
 
-	if len(res.Blobs) == 3 {
-		return true, nil
-	} else if len(res.Blobs) == 0 {
-		return false, nil
-	} else {
-		return false, errors.New("corrupt or incomplete layer encountered")
+	return retry.do("SetBlobMetadata", name, func() error {
+		return client.SetBlobMetadata(container, name, meta)
+	})
+}
+
+// Returns the base64 MD5 of a chunk, as the Content-MD5 header wants it
+func contentMD5(chunk []byte) string {
+	sum := md5.Sum(chunk)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func putSingleBlockBlob(client sdk.BlobStorageClient, container, name string, chunk []byte, retry RetryPolicy) error {
+	if len(chunk) > MaxBlobBlockSize {
+		return fmt.Errorf("storage: provided chunk (%d bytes) cannot fit into single-block blob (max %d bytes)", len(chunk), MaxBlobBlockSize)
 	}
+
+	size := uint64(len(chunk))
+	extraHeaders := make(map[string]string)
+	extraHeaders["Content-MD5"] = contentMD5(chunk)
+
+	return retry.do("PutBlob", name, func() error {
+		return client.CreateBlockBlobFromReader(container, name, size, bytes.NewReader(chunk), extraHeaders)
+	})
 }
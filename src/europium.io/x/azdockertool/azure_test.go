@@ -0,0 +1,400 @@
+package azdockertool
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	sdk "github.com/Azure/azure-sdk-for-go/storage"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeListing serves List Blobs over a fixed set of blobs, pageSize at a
+// time, with the index of the next blob as the continuation marker
+type fakeListing struct {
+	names    []string
+	pageSize int
+	requests int
+}
+
+func (f *fakeListing) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if r.Method != "GET" || r.URL.Path != "/devstoreaccount1/images" || q.Get("comp") != "list" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+
+	f.requests++
+
+	start := 0
+	if marker := q.Get("marker"); marker != "" {
+		var err error
+		if start, err = strconv.Atoi(marker); err != nil {
+			http.Error(w, "bad marker", http.StatusBadRequest)
+			return
+		}
+	}
+
+	type blob struct {
+		Name          string `xml:"Name"`
+		LastModified  string `xml:"Properties>Last-Modified"`
+		ContentLength int64  `xml:"Properties>Content-Length"`
+	}
+
+	res := struct {
+		XMLName    xml.Name `xml:"EnumerationResults"`
+		Prefix     string   `xml:"Prefix"`
+		Marker     string   `xml:"Marker"`
+		NextMarker string   `xml:"NextMarker"`
+		Blobs      []blob   `xml:"Blobs>Blob"`
+	}{Prefix: q.Get("prefix"), Marker: q.Get("marker")}
+
+	end := start + f.pageSize
+	if end < len(f.names) {
+		res.NextMarker = strconv.Itoa(end)
+	} else {
+		end = len(f.names)
+	}
+
+	for _, name := range f.names[start:end] {
+		if strings.HasPrefix(name, res.Prefix) {
+			res.Blobs = append(res.Blobs, blob{name, "Mon, 02 Jan 2006 15:04:05 GMT", 64})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(res)
+}
+
+func TestAzureListBlobsFollowsMarkers(t *testing.T) {
+	listing := &fakeListing{pageSize: 5}
+	for i := 0; i < 12; i++ {
+		listing.names = append(listing.names, fmt.Sprintf("refs/app/v%02d", i))
+	}
+
+	srv := httptest.NewServer(listing)
+	defer srv.Close()
+
+	remote, err := NewAzureBlobStorageRemote(&Config{
+		AccountName:  "devstoreaccount1",
+		AccountKey:   "a2V5",
+		Container:    "images",
+		BlobEndpoint: srv.URL + "/devstoreaccount1",
+		Retry:        RetryPolicy{MaxAttempts: 1},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, err := remote.(*absremote).listBlobs("refs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if listing.requests != 3 {
+		t.Errorf("expected 3 pages to be fetched, got %d", listing.requests)
+	}
+
+	if len(blobs) != len(listing.names) {
+		t.Fatalf("expected %d blobs, got %d", len(listing.names), len(blobs))
+	}
+
+	for i, item := range blobs {
+		if item.Name != listing.names[i] {
+			t.Errorf("blob %d is %s, expected %s", i, item.Name, listing.names[i])
+		}
+
+		if item.Size != 64 || item.LastModified.IsZero() {
+			t.Errorf("blob %s has size %d and time %v", item.Name, item.Size, item.LastModified)
+		}
+	}
+}
+
+// fakeBlocks serves the block blob API, as much of it as putBlockBlob and
+// discardUncommittedBlocks use, keeping blobs in memory
+type fakeBlocks struct {
+	mu    sync.Mutex
+	blobs map[string]*fakeBlob
+	puts  int // Put Block requests
+}
+
+// fakeBlob is a block blob as fakeBlocks keeps it
+type fakeBlob struct {
+	committed   []string          // block ids, in order; nil until committed
+	blocks      map[string][]byte // the committed blocks, by id
+	uncommitted map[string][]byte
+	meta        map[string]string
+}
+
+func newFakeBlocks() *fakeBlocks {
+	return &fakeBlocks{blobs: make(map[string]*fakeBlob)}
+}
+
+// Returns what's committed to a blob
+func (f *fakeBlocks) content(name string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var b []byte
+	if blob, ok := f.blobs[name]; ok {
+		for _, id := range blob.committed {
+			b = append(b, blob.blocks[id]...)
+		}
+	}
+
+	return b
+}
+
+func (f *fakeBlocks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/devstoreaccount1/images/")
+	q := r.URL.Query()
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, ok := f.blobs[name]
+	if !ok && r.Method == "PUT" {
+		blob = &fakeBlob{uncommitted: make(map[string][]byte)}
+		f.blobs[name] = blob
+	} else if !ok || (blob.committed == nil && r.Method == "GET" && q.Get("comp") != "blocklist") {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(xml.Header + "<Error><Code>BlobNotFound</Code><Message>The specified blob does not exist.</Message></Error>"))
+		return
+	}
+
+	switch {
+	case r.Method == "PUT" && q.Get("comp") == "block":
+		blob.uncommitted[q.Get("blockid")] = b
+		f.puts++
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == "PUT" && q.Get("comp") == "blocklist":
+		var list struct {
+			Blocks []struct {
+				XMLName xml.Name
+				ID      string `xml:",chardata"`
+			} `xml:",any"`
+		}
+
+		if err := xml.Unmarshal(b, &list); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		committed := []string{}
+		blocks := make(map[string][]byte)
+		for _, block := range list.Blocks {
+			data, ok := blob.uncommitted[block.ID]
+			if block.XMLName.Local == "Committed" || !ok {
+				data, ok = blob.blocks[block.ID]
+			}
+
+			if !ok {
+				http.Error(w, "InvalidBlockList", http.StatusBadRequest)
+				return
+			}
+
+			committed = append(committed, block.ID)
+			blocks[block.ID] = data
+		}
+
+		// committing throws away every block left out, and the metadata
+		*blob = fakeBlob{committed: committed, blocks: blocks, uncommitted: make(map[string][]byte)}
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == "PUT" && q.Get("comp") == "metadata":
+		blob.meta = make(map[string]string)
+		for k := range r.Header {
+			if strings.HasPrefix(strings.ToLower(k), "x-ms-meta-") {
+				blob.meta[strings.ToLower(k)[len("x-ms-meta-"):]] = r.Header.Get(k)
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == "PUT":
+		*blob = fakeBlob{committed: []string{"blob"}, blocks: map[string][]byte{"blob": b}, uncommitted: make(map[string][]byte)}
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == "GET" && q.Get("comp") == "metadata":
+		for k, v := range blob.meta {
+			w.Header().Set("x-ms-meta-"+k, v)
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == "GET" && q.Get("comp") == "blocklist":
+		var res sdk.BlockListResponse
+		if q.Get("blocklisttype") == "committed" {
+			for _, id := range blob.committed {
+				res.CommittedBlocks = append(res.CommittedBlocks, sdk.BlockResponse{Name: id, Size: int64(len(blob.blocks[id]))})
+			}
+		} else {
+			for id, block := range blob.uncommitted {
+				res.UncommittedBlocks = append(res.UncommittedBlocks, sdk.BlockResponse{Name: id, Size: int64(len(block))})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(res)
+
+	case r.Method == "DELETE":
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+// newFakeBlocksClient returns a client for a fakeBlocks server
+func newFakeBlocksClient(t *testing.T, srv *httptest.Server) sdk.BlobStorageClient {
+	host := strings.TrimPrefix(srv.URL, "http://")
+	client, err := sdk.NewClient("devstoreaccount1", "a2V5", host, sdk.DefaultAPIVersion, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.HTTPClient = &http.Client{Transport: &endpointTransport{host: host, next: http.DefaultTransport}}
+	return client.GetBlobService()
+}
+
+// blockStagingStore is a filesystem remote that sends whatever's staged under
+// uploads/ through putBlockBlob, in blocks of a KiB, and then keeps the blob
+// committed
+type blockStagingStore struct {
+	*FilesystemRemote
+	client sdk.BlobStorageClient
+	blocks *fakeBlocks
+}
+
+func (s *blockStagingStore) putBlob(name string, r io.Reader) error {
+	if !strings.HasPrefix(name, uploadSearchPrefix) {
+		return s.FilesystemRemote.putBlob(name, r)
+	}
+
+	if err := putBlockBlob(s.client, "devstoreaccount1/images", name, r, 1024, 2, RetryPolicy{MaxAttempts: 1}); err != nil {
+		return err
+	}
+
+	return s.FilesystemRemote.putBlob(name, bytes.NewReader(s.blocks.content(name)))
+}
+
+func TestPushResumesAnInterruptedLayer(t *testing.T) {
+	content := strings.Repeat("0123456789abcdef", 1024) // 16 blocks
+
+	for _, config := range []Config{{Layout: LayoutLegacy, Compression: CompressionNone}, {Layout: LayoutCAS, Compression: CompressionNone}} {
+		remote, cleanup := newTestRemote(t, config)
+		defer cleanup()
+
+		blocks := newFakeBlocks()
+		srv := httptest.NewServer(blocks)
+		defer srv.Close()
+
+		fr := remote.(*FilesystemRemote)
+		fr.layout = &layout{fr.config, &blockStagingStore{fr, newFakeBlocksClient(t, srv), blocks}}
+
+		_, save := makeSave(t, "team/app:v1", content)
+
+		// the save is cut off ten blocks into the layer
+		cut := bytes.Index(save, []byte(content)) + 10*1024
+		_, err := remote.Push("team/app:v1", func(repository string, w io.Writer) error {
+			w.Write(save[:cut])
+			return errors.New("daemon went away")
+		}, "")
+
+		if err == nil {
+			t.Fatalf("%s: pushed a save that was cut off", config.Layout)
+		}
+
+		sent := blocks.puts
+		if sent == 0 || sent > 10 {
+			t.Fatalf("%s: the interrupted push sent %d blocks: %v", config.Layout, sent, err)
+		}
+
+		blocks.puts = 0
+		_, err = remote.Push("team/app:v1", func(repository string, w io.Writer) error {
+			_, err := w.Write(save)
+			return err
+		}, "")
+
+		if err != nil {
+			t.Fatalf("%s: %v", config.Layout, err)
+		} else if sent+blocks.puts != 16 {
+			t.Errorf("%s: the second push sent %d blocks, though %d of 16 were sent already", config.Layout, blocks.puts, sent)
+		}
+
+		var loaded map[string][]byte
+		_, err = remote.Pull("team/app:v1", func(ID) (bool, error) { return false, nil }, func(r io.Reader) (err error) {
+			loaded, err = readTar(r)
+			return err
+		})
+
+		if err != nil {
+			t.Fatalf("%s: could not pull: %v", config.Layout, err)
+		}
+
+		for name, b := range loaded {
+			if strings.HasSuffix(name, "/layer.tar") && string(b) != content {
+				t.Errorf("%s: pulled %d bytes of layer, pushed %d", config.Layout, len(b), len(content))
+			}
+		}
+	}
+}
+
+func TestDiscardingBlocksKeepsTheBlobsMetadata(t *testing.T) {
+	blocks := newFakeBlocks()
+	srv := httptest.NewServer(blocks)
+	defer srv.Close()
+
+	client := newFakeBlocksClient(t, srv)
+	container, name, content := "devstoreaccount1/images", "layers/abc/layer.tar", []byte("two blocks")
+	retry := RetryPolicy{MaxAttempts: 1}
+
+	if err := putBlockBlob(client, container, name, bytes.NewReader(content), 5, 1, retry); err != nil {
+		t.Fatal(err)
+	} else if err := client.SetBlobMetadata(container, name, map[string]string{digestMetadataKey: bytesDigest(content)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a block left by an older version, named some other way
+	id := base64.StdEncoding.EncodeToString([]byte("block-0"))
+	if err := client.PutBlockWithLength(container, name, id, 3, bytes.NewReader([]byte("old")), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	uploaded, err := uncommittedBlocks(client, container, name, retry)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(uploaded) != 0 {
+		t.Errorf("expected the older block to be discarded, got %v", uploaded)
+	}
+
+	if b := blocks.content(name); string(b) != string(content) {
+		t.Errorf("blob holds %q, expected %q", b, content)
+	}
+
+	meta, err := client.GetBlobMetadata(container, name)
+	if err != nil {
+		t.Fatal(err)
+	} else if meta[digestMetadataKey] != bytesDigest(content) {
+		t.Errorf("blob's metadata is %v after discarding blocks", meta)
+	}
+}
@@ -0,0 +1,302 @@
+package azdockertool
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"strconv"
+)
+
+const (
+	LayoutLegacy = "legacy" // layers/{id}/ and images/{id}/, as `docker save` lays them out
+	LayoutCAS    = "cas"    // blobs/sha256/{digest}, referenced by digest from each manifest
+
+	blobSearchPrefix   string = "blobs/sha256/"
+	linkSearchPrefix   string = "links/"
+	uploadSearchPrefix string = "uploads/"
+
+	MediaTypeManifest  = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeConfig    = "application/vnd.docker.container.image.v1+json"
+	MediaTypeLayer     = "application/vnd.docker.image.rootfs.diff.tar"
+	MediaTypeLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// annotation on a compressed layer's descriptor giving the size of its
+	// layer.tar before compression, which `docker load` needs up front
+	uncompressedSizeAnnotation = "io.europium.azdockertool.uncompressed.size"
+)
+
+// casManifest is what images/{id}/manifest.json holds in the content
+// addressed layout: a registry (schema 2) manifest, whose config and layers
+// are blobs/sha256/{digest}
+type casManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+}
+
+// descriptor names a blob by its digest
+type descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Size        int64             `json:"size"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func isLayout(layout string) bool {
+	return layout == LayoutLegacy || layout == LayoutCAS
+}
+
+// Returns whether push lays images out by content
+func (l *layout) cas() bool {
+	return l.config.Layout == LayoutCAS
+}
+
+// Returns the name of a content addressed blob
+func blobPath(digest string) string {
+	return blobSearchPrefix + ID(digest).String()
+}
+
+// Returns the media type of a layer stored with codec
+func layerMediaType(codec string) string {
+	switch codec {
+	case CompressionGzip:
+		return MediaTypeLayerGzip
+	case CompressionZstd:
+		return MediaTypeLayerZstd
+	}
+
+	return MediaTypeLayer
+}
+
+// Returns the codec a layer of the given media type is stored with; empty if
+// it isn't compressed
+func layerCodec(mediaType string) (string, error) {
+	switch mediaType {
+	case MediaTypeLayer, MediaTypeOCILayer:
+		return "", nil
+	case MediaTypeLayerGzip, MediaTypeOCILayerGzip:
+		return CompressionGzip, nil
+	case MediaTypeLayerZstd:
+		return CompressionZstd, nil
+	}
+
+	return "", fmt.Errorf("unsupported layer media type '%s'", mediaType)
+}
+
+// Decodes an images/{id}/manifest.json in either layout. A content addressed
+// manifest is presented as a `docker save` one whose layer IDs are the
+// digests of the layer blobs.
+func decodeRemoteManifest(b []byte) (*manifest, error) {
+	if t := bytes.TrimSpace(b); len(t) == 0 || t[0] != '{' {
+		return decodeManifest(bytes.NewReader(b))
+	}
+
+	var cm casManifest
+	if err := json.Unmarshal(b, &cm); err != nil {
+		return nil, err
+	}
+
+	if cm.SchemaVersion != 2 || cm.Config.Digest == "" {
+		return nil, fmt.Errorf("unsupported manifest (schema version %d)", cm.SchemaVersion)
+	}
+
+	m := &manifest{Config: ID(cm.Config.Digest).String() + ".json", cas: &cm}
+	for _, layer := range cm.Layers {
+		m.Layers = append(m.Layers, ID(layer.Digest).String()+"/layer.tar")
+	}
+
+	return m, nil
+}
+
+// Returns the blob holding an image's config
+func (m *manifest) configBlob() string {
+	if m.cas != nil {
+		return blobPath(m.cas.Config.Digest)
+	}
+
+	return fmt.Sprintf("images/%s/json", m.ImageId())
+}
+
+// Returns the blob holding the i'th layer.tar of an image
+func (m *manifest) layerBlob(i int) string {
+	if m.cas != nil {
+		return blobPath(m.cas.Layers[i].Digest)
+	}
+
+	return fmt.Sprintf("layers/%s/layer.tar", m.LayerIds()[i])
+}
+
+// Copies a blob within the remote, server-side if the store can
+func (l *layout) duplicateBlob(src, dst string) error {
+	if bc, ok := l.store.(blobCopier); ok {
+		return bc.copyBlob(src, dst)
+	}
+
+	f, err := l.store.openBlob(src)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = l.putBlobFromReader(dst, f, "")
+	return err
+}
+
+// Returns whether a blob exists
+func (l *layout) hasBlob(name string) (bool, error) {
+	blobs, err := l.store.listBlobs(name)
+	if err != nil {
+		return false, err
+	}
+
+	for _, item := range blobs {
+		if item.Name == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Sends a layer.tar to the remote as a content addressed blob, compressed with
+// codec unless that's CompressionNone. Its digest isn't known until it has all
+// been read, so it's staged under uploads/ and then copied into place, unless
+// an identical blob is there already. Returns the blob's descriptor, the
+// layer's digest uncompressed, and whether the blob is new.
+func (l *layout) putLayerBlob(id ID, r io.Reader, codec string) (*descriptor, string, bool, error) {
+	staging := stagingName(id)
+	defer func() {
+		if err := l.store.deleteBlob(staging); err != nil {
+			log.WithFields(log.Fields{
+				"path":   staging,
+				"reason": err.Error(),
+			}).Warn("failed to delete staged upload")
+		}
+	}()
+
+	var digest, diffID string
+	var c *layerCompression
+	var err error
+	if codec == "" || codec == CompressionNone {
+		digest, err = l.putBlobFromReader(staging, r, "")
+		diffID = digest
+	} else {
+		c, digest, err = l.putCompressedBlob(staging, r, codec, "")
+	}
+
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	blobs, err := l.store.listBlobs(staging)
+	if err != nil {
+		return nil, "", false, err
+	} else if len(blobs) != 1 {
+		return nil, "", false, fmt.Errorf("staged upload '%s' went missing", staging)
+	}
+
+	desc := &descriptor{MediaType: layerMediaType(codec), Size: blobs[0].Size, Digest: digest}
+	if c != nil {
+		diffID = c.Digest
+		desc.Annotations = map[string]string{uncompressedSizeAnnotation: strconv.FormatInt(c.Size, 10)}
+	}
+
+	exists, err := l.hasBlob(blobPath(digest))
+	if err != nil || exists {
+		return desc, diffID, false, err
+	}
+
+	if err := l.duplicateBlob(staging, blobPath(digest)); err != nil {
+		return nil, "", false, err
+	}
+
+	return desc, diffID, true, nil
+}
+
+// Returns the name to stage a layer's layer.tar under. It's the same for every
+// push of the layer, so that one interrupted leaves behind blocks the next can
+// reuse (see putBlockBlob).
+func stagingName(id ID) string {
+	return fmt.Sprintf("%slayers/%s", uploadSearchPrefix, id)
+}
+
+// Records that a layer of a save is stored as the given blob, as
+// links/{layer id}/{digest}, so that pushing it again can be skipped
+func (l *layout) putLink(id ID, desc *descriptor) (string, error) {
+	b, err := json.Marshal(desc)
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s%s/%s", linkSearchPrefix, id, ID(desc.Digest))
+	return name, l.store.putBlob(name, bytes.NewReader(b))
+}
+
+// Returns what a layer of a save was stored as, if a link to it names a blob
+// that's still there; nil if none does
+func (l *layout) findLink(id ID) (*descriptor, error) {
+	links, err := l.store.listBlobs(fmt.Sprintf("%s%s/", linkSearchPrefix, id))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range links {
+		var desc descriptor
+		if err := l.getJSON(item.Name, &desc); err != nil {
+			return nil, fmt.Errorf("could not read '%s': %v", item.Name, err)
+		}
+
+		ok, err := l.hasBlob(blobPath(desc.Digest))
+		if err != nil {
+			return nil, err
+		} else if ok {
+			return &desc, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Uploads an image's config and manifest in the content addressed layout;
+// the manifest goes last, since it's what makes the image visible
+func (l *layout) putCASImage(id ID, config []byte, layers []descriptor) error {
+	cm := &casManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config: descriptor{
+			MediaType: MediaTypeConfig,
+			Size:      int64(len(config)),
+			Digest:    imageDigest(id),
+		},
+		Layers: layers,
+	}
+
+	b, err := json.Marshal(cm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.putBlobFromReader(blobPath(cm.Config.Digest), bytes.NewReader(config), cm.Config.Digest); err != nil {
+		return err
+	}
+
+	_, err = l.putBlobFromReader(fmt.Sprintf("images/%s/manifest.json", id), bytes.NewReader(b), "")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"image id": string(id),
+			"rollback": false,
+		}).Error("failed to upload image metadata")
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"image id": string(id),
+	}).Info("published image")
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package azdockertool
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+var (
+	ErrCorruptCompression error = errors.New("compressed layer is corrupt")
+)
+
+const (
+	CompressionNone = "none" // layer.tar is stored as docker saved it
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	// key of the record push adds to a compressed layer's json
+	compressionJSONKey = "azdockertool_compression"
+)
+
+// layerCompression is how a layer's layer.tar is stored, as recorded in its
+// json on the remote. Layers without one are stored as docker saved them.
+type layerCompression struct {
+	Codec  string `json:"codec"`
+	Digest string `json:"digest"` // of the layer.tar before compression
+	Size   int64  `json:"size"`   // of the layer.tar before compression
+}
+
+func isCodec(codec string) bool {
+	return codec == CompressionNone || codec == CompressionGzip || codec == CompressionZstd
+}
+
+// Returns how a layer is stored, given its json; nil if it isn't compressed
+func readLayerCompression(b []byte) (*layerCompression, error) {
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(b, &record); err != nil {
+		return nil, fmt.Errorf("could not read layer json: %v", err)
+	}
+
+	raw, ok := record[compressionJSONKey]
+	if !ok {
+		return nil, nil
+	}
+
+	var c layerCompression
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, fmt.Errorf("could not read layer compression: %v", err)
+	}
+
+	if !isCodec(c.Codec) {
+		return nil, fmt.Errorf("layer is compressed with '%s', which this version doesn't support", c.Codec)
+	}
+
+	if c.Codec == CompressionNone {
+		return nil, nil
+	}
+
+	return &c, nil
+}
+
+// Returns how a layer in the remote is stored; nil if it isn't compressed
+func (l *layout) getLayerCompression(id ID) (*layerCompression, error) {
+	b, err := l.getBlob(fmt.Sprintf("layers/%s/json", id))
+	if err != nil {
+		return nil, err
+	}
+
+	return readLayerCompression(b)
+}
+
+// Adds a compression record to a layer's json
+func withLayerCompression(b []byte, c *layerCompression) ([]byte, error) {
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(b, &record); err != nil {
+		return nil, fmt.Errorf("could not read layer json: %v", err)
+	}
+
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	record[compressionJSONKey] = raw
+	return json.Marshal(record)
+}
+
+// Returns a writer that compresses what's written to it into w; closing it
+// flushes the compressed stream, but doesn't close w
+func compressor(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+
+	return nil, fmt.Errorf("unknown compression '%s'", codec)
+}
+
+// Returns a reader that decompresses the named blob from r; closing it
+// closes r. A stream that doesn't decompress fails with ErrCorruptCompression.
+func decompressor(name, codec string, r io.ReadCloser) (io.ReadCloser, error) {
+	src := &decompressingReader{name: name, codec: codec, raw: &recordingReader{r: r}, src: r}
+
+	var err error
+	switch codec {
+	case CompressionGzip:
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(src.raw)
+		if err == nil {
+			src.Reader, src.close = zr, zr.Close
+		}
+	case CompressionZstd:
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(src.raw)
+		if err == nil {
+			src.Reader, src.close = zr, func() error { zr.Close(); return nil }
+		}
+	default:
+		r.Close()
+		return nil, fmt.Errorf("unknown compression '%s'", codec)
+	}
+
+	if err != nil {
+		r.Close()
+		return nil, src.failed(err)
+	}
+
+	return src, nil
+}
+
+// decompressingReader reads a decompressed stream, closing both the
+// decompressor and what it reads from when done
+type decompressingReader struct {
+	io.Reader
+	name  string
+	codec string
+	raw   *recordingReader
+	src   io.Closer
+	close func() error
+}
+
+func (d *decompressingReader) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = d.failed(err)
+	}
+
+	return n, err
+}
+
+// Returns the error to fail with: the blob's, if reading it failed, or else
+// ErrCorruptCompression, after logging why it didn't decompress
+func (d *decompressingReader) failed(err error) error {
+	if d.raw.err != nil && d.raw.err != io.EOF {
+		return d.raw.err
+	}
+
+	log.WithFields(log.Fields{
+		"name":   d.name,
+		"codec":  d.codec,
+		"reason": err.Error(),
+	}).Error("could not decompress")
+
+	return ErrCorruptCompression
+}
+
+func (d *decompressingReader) Close() error {
+	err := d.close()
+	if serr := d.src.Close(); err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// recordingReader remembers the last error reading from r
+type recordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if err != nil {
+		rr.err = err
+	}
+
+	return n, err
+}
+
+// Sends a stream to the remote compressed with codec, and returns the digest
+// and size it had before compression, and the digest of what was stored.
+// Given the digest to expect, a stream that doesn't match it is never
+// committed.
+func (l *layout) putCompressedBlob(name string, r io.Reader, codec, digest string) (*layerCompression, string, error) {
+	type result struct {
+		n   int64
+		err error
+	}
+
+	d := newDigestingReader(name, r, digest)
+	pr, pw := io.Pipe()
+	done := make(chan result, 1)
+
+	go func() {
+		zw, err := compressor(codec, pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			done <- result{0, err}
+			return
+		}
+
+		n, err := io.Copy(zw, d)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+
+		pw.CloseWithError(err)
+		done <- result{n, err}
+	}()
+
+	stored, err := l.putBlobFromReader(name, pr, "")
+
+	// stops the compressor if the upload gave up part way
+	pr.CloseWithError(err)
+	res := <-done
+
+	if res.err != nil {
+		return nil, "", res.err
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	return &layerCompression{Codec: codec, Digest: d.Digest(), Size: res.n}, stored, nil
+}
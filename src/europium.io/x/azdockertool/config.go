@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"github.com/BurntSushi/toml"
 	homedir "github.com/mitchellh/go-homedir"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 var (
@@ -14,21 +17,85 @@ var (
 	ErrCannotAccessConfigFile = errors.New("configuration unavailable")
 )
 
+const (
+	// how long gc leaves unreachable blobs alone, in case a push is still in flight
+	DefaultGCGracePeriod = 24 * time.Hour
+
+	// how many blocks (push) or ranges of a large blob (pull) are transferred at once
+	DefaultConcurrency = 4
+
+	// how storage operations that fail transiently are retried
+	DefaultRetryAttempts   = 5
+	DefaultRetryBackoff    = 500 * time.Millisecond
+	DefaultRetryMaxBackoff = 30 * time.Second
+
+	// how push stores layers unless the environment says otherwise
+	DefaultCompression = CompressionNone
+
+	// how push lays out images unless the environment says otherwise
+	DefaultLayout = LayoutLegacy
+
+	// the well-known account of the storage emulator (Azurite)
+	DevStoreAccountName  = "devstoreaccount1"
+	DevStoreAccountKey   = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	DevStoreBlobEndpoint = "http://127.0.0.1:10000/devstoreaccount1"
+)
+
 const (
 	prefab string = `[default]
 storage_account_name = "YOUR_STORAGE_ACCOUNT"
 storage_account_access_key = "WU9VUl9TVE9SQUdFX0FDQ09VTlRfS0VZCg=="
 container = "YOUR_CONTAINER"
+# concurrency = 4
+# retry_max_attempts = 5
+# retry_backoff = "500ms"
+# retry_max_backoff = "30s"
+# compression = "none" # or "gzip" or "zstd"; applies to layers pushed from now on
+# layout = "legacy" # or "cas"; see the migrate command
+# no_clobber = true # refuse to move existing tags to another image
+
+# environments may also live in a local or NFS mounted directory
+# [offline]
+# type = "filesystem"
+# path = "/mnt/azdockertool"
+
+# or in the storage emulator (Azurite), or any other blob endpoint
+# [azurite]
+# use_development_storage = true
+# container = "images"
+#
+# [sovereign]
+# connection_string = "DefaultEndpointsProtocol=https;AccountName=...;AccountKey=...;EndpointSuffix=core.chinacloudapi.cn"
+# container = "images"
+
+# instead of the account key, a container-scoped SAS token may be given inline
+# (sas_token), read from a file (sas_token_file) or from the environment
+# [readonly]
+# storage_account_name = "YOUR_STORAGE_ACCOUNT"
+# container = "YOUR_CONTAINER"
+# sas_token_env = "AZDOCKERTOOL_SAS_TOKEN"
 `
 )
 
 type Config struct {
-	AccountName string
-	AccountKey  string
-	Container   string
-	Verbose     bool
-	HomeDir     string
-	Docker      *DockerConfig
+	Type           string // azure (the default) or filesystem
+	Path           string // root directory of a filesystem remote
+	AccountName    string
+	AccountKey     string
+	SASToken       string // used instead of AccountKey when set
+	Container      string
+	BlobEndpoint   string // e.g. http://127.0.0.1:10000/devstoreaccount1; overrides EndpointSuffix
+	EndpointSuffix string // e.g. core.windows.net
+	UseHTTPS       bool
+	GCGrace        time.Duration
+	Concurrency    int // parallel transfers; see DefaultConcurrency
+	Retry          RetryPolicy
+	Compression    string // codec push stores layer.tar with; see CompressionNone
+	Layout         string // how push lays out images; see LayoutLegacy
+	NoClobber      bool   // refuse to move tags that already name an image
+	Verbose        bool
+	HomeDir        string
+	Docker         *DockerConfig
 }
 
 type DockerConfig struct {
@@ -52,9 +119,27 @@ func GetConfig(environment string, verbose bool) (*Config, error) {
 	}
 
 	type envInfo struct {
-		AccountName string `toml:"storage_account_name"`
-		AccountKey  string `toml:"storage_account_access_key"`
-		Container   string `toml:"container"`
+		Type             string `toml:"type"`
+		Path             string `toml:"path"`
+		AccountName      string `toml:"storage_account_name"`
+		AccountKey       string `toml:"storage_account_access_key"`
+		SASToken         string `toml:"sas_token"`
+		SASTokenFile     string `toml:"sas_token_file"`
+		SASTokenEnv      string `toml:"sas_token_env"`
+		Container        string `toml:"container"`
+		BlobEndpoint     string `toml:"blob_endpoint"`
+		EndpointSuffix   string `toml:"endpoint_suffix"`
+		UseHTTPS         *bool  `toml:"use_https"`
+		DevStorage       bool   `toml:"use_development_storage"`
+		ConnectionString string `toml:"connection_string"`
+		GCGrace          string `toml:"gc_grace_period"`
+		Concurrency      int    `toml:"concurrency"`
+		RetryAttempts    int    `toml:"retry_max_attempts"`
+		RetryBackoff     string `toml:"retry_backoff"`
+		RetryMaxBackoff  string `toml:"retry_max_backoff"`
+		Compression      string `toml:"compression"`
+		Layout           string `toml:"layout"`
+		NoClobber        bool   `toml:"no_clobber"`
 	}
 
 	var config map[string]envInfo
@@ -67,18 +152,181 @@ func GetConfig(environment string, verbose bool) (*Config, error) {
 		return nil, ErrEnvironmentNotFound
 	}
 
+	grace := DefaultGCGracePeriod
+	if env.GCGrace != "" {
+		grace, err = time.ParseDuration(env.GCGrace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gc_grace_period: %v", err)
+		}
+	}
+
+	concurrency := DefaultConcurrency
+	if env.Concurrency < 0 {
+		return nil, fmt.Errorf("invalid concurrency: %d", env.Concurrency)
+	} else if env.Concurrency > 0 {
+		concurrency = env.Concurrency
+	}
+
+	retry := DefaultRetryPolicy()
+	if env.RetryAttempts < 0 {
+		return nil, fmt.Errorf("invalid retry_max_attempts: %d", env.RetryAttempts)
+	} else if env.RetryAttempts > 0 {
+		retry.MaxAttempts = env.RetryAttempts
+	}
+
+	if env.RetryBackoff != "" {
+		retry.Backoff, err = time.ParseDuration(env.RetryBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry_backoff: %v", err)
+		}
+	}
+
+	if env.RetryMaxBackoff != "" {
+		retry.MaxBackoff, err = time.ParseDuration(env.RetryMaxBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retry_max_backoff: %v", err)
+		}
+	}
+
+	compression := DefaultCompression
+	if env.Compression != "" {
+		if !isCodec(env.Compression) {
+			return nil, fmt.Errorf("invalid compression '%s' (expected none, gzip or zstd)", env.Compression)
+		}
+
+		compression = env.Compression
+	}
+
+	layout := DefaultLayout
+	if env.Layout != "" {
+		if !isLayout(env.Layout) {
+			return nil, fmt.Errorf("invalid layout '%s' (expected legacy or cas)", env.Layout)
+		}
+
+		layout = env.Layout
+	}
+
 	cfg := &Config{
-		AccountName: env.AccountName,
-		AccountKey:  env.AccountKey,
-		Container:   env.Container,
+		Type:        env.Type,
+		Path:        env.Path,
+		UseHTTPS:    true,
+		GCGrace:     grace,
+		Concurrency: concurrency,
+		Retry:       retry,
+		Compression: compression,
+		Layout:      layout,
+		NoClobber:   env.NoClobber,
 		Verbose:     verbose,
 		HomeDir:     dir,
 		Docker:      getDockerConfig(dir),
 	}
 
+	// a connection string supplies the defaults; explicit keys override it
+	if env.ConnectionString != "" {
+		if err := applyConnectionString(cfg, env.ConnectionString); err != nil {
+			return nil, err
+		}
+	}
+
+	if env.DevStorage {
+		applyDevelopmentStorage(cfg)
+	}
+
+	cfg.AccountName = firstNonEmpty(env.AccountName, cfg.AccountName)
+	cfg.AccountKey = firstNonEmpty(env.AccountKey, cfg.AccountKey)
+	cfg.SASToken = firstNonEmpty(env.SASToken, cfg.SASToken)
+	cfg.Container = firstNonEmpty(env.Container, cfg.Container)
+	cfg.BlobEndpoint = firstNonEmpty(env.BlobEndpoint, cfg.BlobEndpoint)
+	cfg.EndpointSuffix = firstNonEmpty(env.EndpointSuffix, cfg.EndpointSuffix)
+
+	if env.UseHTTPS != nil {
+		cfg.UseHTTPS = *env.UseHTTPS
+	}
+
+	if env.SASTokenFile != "" {
+		path, err := homedir.Expand(env.SASTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sas_token_file: %v", err)
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read sas_token_file: %v", err)
+		}
+
+		cfg.SASToken = string(b)
+	}
+
+	if env.SASTokenEnv != "" {
+		token := os.Getenv(env.SASTokenEnv)
+		if token == "" {
+			return nil, fmt.Errorf("sas_token_env: $%s is not set", env.SASTokenEnv)
+		}
+
+		cfg.SASToken = token
+	}
+
+	cfg.SASToken = strings.TrimPrefix(strings.TrimSpace(cfg.SASToken), "?")
+
 	return cfg, nil
 }
 
+// Fills in the account and endpoint from an Azure Storage connection string,
+// e.g. "DefaultEndpointsProtocol=https;AccountName=x;AccountKey=y;EndpointSuffix=core.windows.net"
+func applyConnectionString(cfg *Config, conn string) error {
+	for _, part := range strings.Split(conn, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid connection_string: malformed setting '%s'", part)
+		}
+
+		key, value := kv[0], kv[1]
+		switch strings.ToLower(key) {
+		case "defaultendpointsprotocol":
+			cfg.UseHTTPS = strings.ToLower(value) != "http"
+		case "accountname":
+			cfg.AccountName = value
+		case "accountkey":
+			cfg.AccountKey = value
+		case "blobendpoint":
+			cfg.BlobEndpoint = value
+		case "endpointsuffix":
+			cfg.EndpointSuffix = value
+		case "sharedaccesssignature":
+			cfg.SASToken = value
+		case "usedevelopmentstorage":
+			if strings.ToLower(value) == "true" {
+				applyDevelopmentStorage(cfg)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Points the environment at the storage emulator's well-known account
+func applyDevelopmentStorage(cfg *Config) {
+	cfg.AccountName = DevStoreAccountName
+	cfg.AccountKey = DevStoreAccountKey
+	cfg.BlobEndpoint = DevStoreBlobEndpoint
+	cfg.UseHTTPS = false
+}
+
+func firstNonEmpty(coll ...string) string {
+	for _, s := range coll {
+		if s != "" {
+			return s
+		}
+	}
+
+	return ""
+}
+
 func ensureConfigFileExists(homedir string, verbose bool) (string, error) {
 	path := filepath.Join(homedir, ".azdockertool.toml")
 	if _, err := os.Stat(path); os.IsNotExist(err) {
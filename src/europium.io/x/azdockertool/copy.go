@@ -0,0 +1,285 @@
+package azdockertool
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnsupportedRemote error = errors.New("remote is not one this package made")
+)
+
+// Copies an image, given a tag or (partial) image ID, into another remote
+// without going through Docker, and tags it there: as tag, if given, or else
+// as it's tagged here; if expect is given, only if the tag names that
+// (partial) image ID there now. Layers the destination already has are
+// skipped; the rest are copied as stored (server-side, where the stores can),
+// in whichever layout they're in here, and checked as they're streamed
+// otherwise. As with push, manifest.json goes last, and layers copied are
+// deleted again if anything fails before then.
+func (l *layout) Copy(query string, dst Remote, tag string, expect ID) (*CopyResult, error) {
+	d, ok := dst.(interface {
+		remoteLayout() *layout
+	})
+
+	if !ok {
+		return nil, ErrUnsupportedRemote
+	}
+
+	to := d.remoteLayout()
+
+	if err := l.checkPermissions("cp", "rl"); err != nil {
+		return nil, err
+	} else if err := to.checkPermissions("cp", "rlw"); err != nil {
+		return nil, err
+	}
+
+	id, repo, srcTag, err := l.resolveImage(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if tag == "" {
+		if repo == "" {
+			return nil, fmt.Errorf("give a tag to copy image '%s' to", id.Short())
+		}
+
+		tag = fmt.Sprintf("%s:%s", repo, srcTag)
+	}
+
+	res := &CopyResult{Id: id}
+	res.Repository, res.Tag = toRepositoryAndTag(tag)
+
+	m, err := l.getManifest(fmt.Sprintf("images/%s/manifest.json", id))
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest of image '%s': %v", id.Short(), err)
+	}
+
+	res.Present, err = to.hasBlob(fmt.Sprintf("images/%s/manifest.json", id))
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := to.readRefs(id, []string{tag}, expect)
+	if err != nil {
+		return nil, err
+	}
+
+	if !res.Present {
+		if res.Layers, err = l.copyImage(to, id, m); err != nil {
+			return res, err
+		}
+	}
+
+	return res, to.putRefs(id, refs, expect)
+}
+
+// Returns the layout of a remote this package made
+func (l *layout) remoteLayout() *layout {
+	return l
+}
+
+// copiedBlob is a blob to copy, and the digest to check it against, where
+// that's known without reading it
+type copiedBlob struct {
+	name   string
+	digest string
+}
+
+// Copies an image's layers and then its metadata into another remote
+func (l *layout) copyImage(to *layout, id ID, m *manifest) ([]LayerStatus, error) {
+	ids := m.LayerIds()
+	statuses := make([]LayerStatus, len(ids))
+
+	config, err := l.getBlob(m.configBlob())
+	if err != nil {
+		return nil, err
+	} else if err := checkDigest(m.configBlob(), imageDigest(id), bytesDigest(config)); err != nil {
+		return nil, err
+	}
+
+	digests, err := layerDigests(m, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var sent []string
+	published := false
+
+	defer func() {
+		if !published {
+			to.rollbackBlobs(sent)
+		}
+	}()
+
+	err = forEachParallel(to.config.Concurrency, len(ids), func(i int, stop <-chan struct{}) error {
+		blobs, err := l.missingLayerBlobs(to, m, i, digests)
+		if err != nil {
+			return err
+		}
+
+		statuses[i] = LayerStatus{Id: ids[i], Status: LayerFound}
+		if len(blobs) == 0 {
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"layer id": string(ids[i]),
+		}).Info("copying layer")
+
+		for _, blob := range blobs {
+			if stopped(stop) {
+				return nil
+			}
+
+			// rolled back even if it only got part way
+			mu.Lock()
+			sent = append(sent, blob.name)
+			mu.Unlock()
+
+			if err := to.importBlob(l, blob.name, blob.digest); err != nil {
+				statuses[i].Status = LayerFailed
+				return fmt.Errorf("could not copy '%s': %v", blob.name, err)
+			}
+		}
+
+		statuses[i].Status = LayerSent
+		return nil
+	})
+
+	if err != nil {
+		// leaving out the layers that were never started
+		var started []LayerStatus
+		for _, status := range statuses {
+			if status.Id != "" {
+				started = append(started, status)
+			}
+		}
+
+		return started, err
+	}
+
+	// manifest.json goes last; it's what makes the image visible
+	blobs := []copiedBlob{{m.configBlob(), imageDigest(id)}}
+
+	others, err := l.listBlobNames(fmt.Sprintf("images/%s/", id))
+	if err != nil {
+		return statuses, err
+	}
+
+	for _, name := range others {
+		if name != m.configBlob() && !strings.HasSuffix(name, "/manifest.json") {
+			blobs = append(blobs, copiedBlob{name: name})
+		}
+	}
+
+	blobs = append(blobs, copiedBlob{name: fmt.Sprintf("images/%s/manifest.json", id)})
+
+	for _, blob := range blobs {
+		if err := to.importBlob(l, blob.name, blob.digest); err != nil {
+			log.WithFields(log.Fields{
+				"image id": string(id),
+				"rollback": true,
+			}).Error("failed to copy image metadata")
+			return statuses, err
+		}
+	}
+
+	published = true
+
+	log.WithFields(log.Fields{
+		"image id": string(id),
+	}).Info("published image")
+
+	return statuses, nil
+}
+
+// Returns the blobs of an image's i'th layer that another remote is missing;
+// none if it has the layer already. A layer.tar stored as docker saved it is
+// checked against its digest in the image config.
+func (l *layout) missingLayerBlobs(to *layout, m *manifest, i int, digests map[ID]string) ([]copiedBlob, error) {
+	if m.cas != nil {
+		name := m.layerBlob(i)
+		ok, err := to.hasBlob(name)
+		if err != nil || ok {
+			return nil, err
+		}
+
+		return []copiedBlob{{name, m.cas.Layers[i].Digest}}, nil
+	}
+
+	id := m.LayerIds()[i]
+	ok, err := to.HasLayer(id)
+	if err != nil && err != ErrIncompleteLayer {
+		return nil, err
+	} else if ok {
+		return nil, nil
+	}
+
+	names, err := l.listBlobNames(fmt.Sprintf("layers/%s/", id))
+	if err != nil {
+		return nil, err
+	} else if len(names) != len(layerFiles) {
+		return nil, fmt.Errorf("corrupt or incomplete layer '%s' (found %d of %d files)", id.Short(), len(names), len(layerFiles))
+	}
+
+	c, err := l.getLayerCompression(id)
+	if err != nil {
+		return nil, fmt.Errorf("layer '%s': %v", id.Short(), err)
+	}
+
+	var blobs []copiedBlob
+	for _, name := range names {
+		blob := copiedBlob{name: name}
+		if c == nil && name == m.layerBlob(i) {
+			blob.digest = digests[id]
+		}
+
+		blobs = append(blobs, blob)
+	}
+
+	return blobs, nil
+}
+
+// Copies a blob from another remote under the same name: server-side, where
+// the stores can, or else by streaming it through, checked against the given
+// digest (or else what the source recorded for it)
+func (l *layout) importBlob(src *layout, name, digest string) error {
+	if rc, ok := l.store.(remoteCopier); ok {
+		done, err := rc.copyRemoteBlob(src.store, name)
+		if done || err != nil {
+			return err
+		}
+	}
+
+	item, err := src.statBlob(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := src.openVerified(item, digest)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = l.putBlobFromReader(name, f, "")
+	return err
+}
+
+// Deletes blobs a copy sent, in reverse
+func (l *layout) rollbackBlobs(names []string) {
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := l.store.deleteBlob(names[i]); err != nil {
+			log.WithFields(log.Fields{
+				"path":   names[i],
+				"reason": err.Error(),
+			}).Error("failed to roll back blob")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package azdockertool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"hash"
+	"io"
+)
+
+var (
+	ErrDigestMismatch error = errors.New("content does not match its digest")
+)
+
+const (
+	// blob metadata key under which push records a blob's digest
+	digestMetadataKey string = "digest"
+)
+
+// imageConfig is the part of an image config (images/{id}/json) that ties an
+// image to the contents of its layers
+type imageConfig struct {
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// Pairs each layer of the manifest with the digest of its layer.tar, as
+// given by the image config.
+//
+// Layer directory names in a `docker save` are not digests of anything (they
+// are made up for the benefit of older Dockers); the config's diff_ids are.
+func layerDigests(m *manifest, b []byte) (map[ID]string, error) {
+	var config imageConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("could not read image config: %v", err)
+	}
+
+	ids := m.LayerIds()
+	if len(ids) != len(config.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("image config lists %d layers, but the manifest has %d", len(config.RootFS.DiffIDs), len(ids))
+	}
+
+	digests := make(map[ID]string)
+	for i, id := range ids {
+		digests[id] = config.RootFS.DiffIDs[i]
+	}
+
+	return digests, nil
+}
+
+// Returns the digest of an image's config, which is what its ID is
+func imageDigest(id ID) string {
+	return "sha256:" + id.String()
+}
+
+// digestingReader hashes whatever is read through it. Given a digest to
+// expect, it fails the final read with ErrDigestMismatch instead of io.EOF if
+// the contents don't match, so nothing downstream mistakes them for good.
+type digestingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	name     string
+	expected string
+}
+
+func newDigestingReader(name string, r io.Reader, expected string) *digestingReader {
+	return &digestingReader{r: r, h: sha256.New(), name: name, expected: expected}
+}
+
+func (d *digestingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+
+	if err == io.EOF && d.expected != "" {
+		if err := checkDigest(d.name, d.expected, d.Digest()); err != nil {
+			return n, err
+		}
+	}
+
+	return n, err
+}
+
+// Returns the digest of everything read so far
+func (d *digestingReader) Digest() string {
+	return "sha256:" + hex.EncodeToString(d.h.Sum(nil))
+}
+
+// Returns the digest of a byte slice
+func bytesDigest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Returns ErrDigestMismatch, after logging what didn't match, unless the
+// digests are the same
+func checkDigest(name, expected, actual string) error {
+	if expected == actual {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"name":     name,
+		"expected": expected,
+		"actual":   actual,
+	}).Error("digest mismatch")
+
+	return ErrDigestMismatch
+}
@@ -3,9 +3,7 @@ package azdockertool
 import (
 	//log "github.com/Sirupsen/logrus"
 	docker "github.com/fsouza/go-dockerclient"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"io"
 )
 
 func NewDockerClient(config *Config) (client *docker.Client, err error) {
@@ -30,51 +28,17 @@ func DockerImageExists(client *docker.Client, id ID) (ok bool, err error) {
 	}
 }
 
-// loads an image from a tarball
-func DockerLoad(client *docker.Client, srcdir string) error {
-	cmd := exec.Command("tar", "cvf", "-", "-C", srcdir, ".")
-	cmd.Env = os.Environ()
-	cmd.Dir = srcdir
-	defer cmd.Wait()
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-
-	if err := cmd.Start(); err != nil {
-		return err
-	}
-
-	// loads a tarball from stdout into the Docker host
-	err = client.LoadImage(docker.LoadImageOptions{InputStream: stdout})
-	if err != nil {
-		return err
-	}
-
-	return nil
+// tags an image already known to the Docker host
+func DockerTag(client *docker.Client, id ID, repository, tag string) error {
+	return client.TagImage(id.String(), docker.TagImageOptions{Repo: repository, Tag: tag, Force: true})
 }
 
-// exports an (uncompressed) image to disk
-func DockerSave(client *docker.Client, repository, dstdir string) error {
-	// writes the image to disk
-	tarfile := filepath.Join(dstdir, "image.tar")
-	cmd0 := exec.Command("docker", "save", "-o", tarfile, repository)
-	cmd0.Env = os.Environ()
-	cmd0.Dir = dstdir
-
-	if err := cmd0.Run(); err != nil {
-		return ErrNoSuchImage
-	}
-
-	// expand the tar file
-	cmd1 := exec.Command("tar", "xvf", "image.tar", "-C", dstdir)
-	cmd1.Env = os.Environ()
-	cmd1.Dir = dstdir
-
-	if err := cmd1.Run(); err != nil {
-		return err
-	}
+// loads an image from a stream, as `docker save` would write it
+func DockerLoad(client *docker.Client, r io.Reader) error {
+	return client.LoadImage(docker.LoadImageOptions{InputStream: r})
+}
 
-	return nil
+// streams an image, as `docker save` would write it, to w
+func DockerSave(client *docker.Client, repository string, w io.Writer) error {
+	return client.ExportImages(docker.ExportImagesOptions{Names: []string{repository}, OutputStream: w})
 }
@@ -0,0 +1,395 @@
+package azdockertool
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidBlobName error = errors.New("invalid blob name")
+)
+
+const (
+	// prefix of the files being written by putBlob; never listed
+	fsTempPrefix string = ".azdockertool-"
+
+	// how long putBlobIfMatch waits for another writer's lock, and how old a
+	// lock must be before it's taken to belong to a writer that died holding
+	// it (it's only ever held for a read and a small write)
+	fsLockAttempts = 150
+	fsLockDelay    = 100 * time.Millisecond
+	fsLockStale    = 10 * time.Second
+
+	// how many times a blob's directory is made again, having been pruned by
+	// deleteBlob before anything could be put in it
+	fsMkdirAttempts = 10
+)
+
+// FilesystemRemote keeps the container structure in a local (or NFS mounted)
+// directory instead of Azure Blob Storage
+type FilesystemRemote struct {
+	*layout
+	root string
+}
+
+// Returns a filesystem backend rooted at config.Path
+func NewFilesystemRemote(config *Config) (Remote, error) {
+	if config.Path == "" {
+		return nil, errors.New("filesystem remote requires a path")
+	}
+
+	root, err := filepath.Abs(config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(root, os.ModeDir|0755); err != nil {
+		return nil, fmt.Errorf("could not create remote directory '%s': %v", root, err)
+	}
+
+	remote := &FilesystemRemote{root: root}
+	remote.layout = &layout{config, remote}
+
+	return remote, nil
+}
+
+// Lists every blob sharing a prefix
+func (fr *FilesystemRemote) listBlobs(prefix string) ([]blobInfo, error) {
+	// only walk the part of the tree the prefix could match
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	}
+
+	start, err := fr.pathOf(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var coll []blobInfo
+
+	err = filepath.Walk(start, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasPrefix(info.Name(), fsTempPrefix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(fr.root, path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		coll = append(coll, blobInfo{
+			Name:         name,
+			Size:         info.Size(),
+			LastModified: info.ModTime().UTC(),
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("remote unavailable: %s", err)
+	}
+
+	// in name order, as Azure lists them; walking visits "a/b" before "a.b"
+	sort.Sort(byBlobName(coll))
+
+	return coll, nil
+}
+
+// Opens a blob for reading
+func (fr *FilesystemRemote) openBlob(name string) (io.ReadCloser, error) {
+	path, err := fr.pathOf(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+
+	return f, err
+}
+
+// Writes a blob; readers never see a partially written file because it is
+// written alongside and renamed into place
+func (fr *FilesystemRemote) putBlob(name string, r io.Reader) error {
+	path, err := fr.pathOf(name)
+	if err != nil {
+		return err
+	}
+
+	var f *os.File
+	err = fsCreateInDir(filepath.Dir(path), func(dir string) (err error) {
+		f, err = ioutil.TempFile(dir, fsTempPrefix)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name()) // no-op once renamed
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Reads a blob, and an ETag for it: the digest of what it holds
+func (fr *FilesystemRemote) getBlobETag(name string) ([]byte, string, error) {
+	f, err := fr.openBlob(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return b, bytesDigest(b), nil
+}
+
+// Writes a small blob if it still has the given ETag or, given none, if it
+// doesn't exist. Writers take turns holding a lock file beside the blob
+// (created exclusively, which is atomic, over NFS too), so that checking and
+// writing can't interleave.
+func (fr *FilesystemRemote) putBlobIfMatch(name string, b []byte, etag string) error {
+	path, err := fr.pathOf(name)
+	if err != nil {
+		return err
+	}
+
+	var unlock func()
+	err = fsCreateInDir(filepath.Dir(path), func(string) (err error) {
+		unlock, err = fsLock(fsLockPath(path))
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	_, current, err := fr.getBlobETag(name)
+	if err != nil && err != ErrBlobNotFound {
+		return err
+	} else if current != etag {
+		return errPreconditionFailed
+	}
+
+	return fr.putBlob(name, bytes.NewReader(b))
+}
+
+// Deletes a blob if it still has the given ETag, holding the same lock as
+// putBlobIfMatch
+func (fr *FilesystemRemote) deleteBlobIfMatch(name, etag string) error {
+	path, err := fr.pathOf(name)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := fsLock(fsLockPath(path))
+	if os.IsNotExist(err) {
+		return nil // nor is its directory
+	} else if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	_, current, err := fr.getBlobETag(name)
+	if err == ErrBlobNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	} else if current != etag {
+		return errPreconditionFailed
+	}
+
+	return fr.deleteBlob(name)
+}
+
+// Returns the lock file that conditional writes to a blob take turns holding
+func fsLockPath(path string) string {
+	return filepath.Join(filepath.Dir(path), fsTempPrefix+filepath.Base(path)+".lock")
+}
+
+// Takes a lock file, waiting a while for whoever holds it; returns a func
+// that releases it. The lock records who took it and when; one left stale by
+// a writer that died is taken over.
+func fsLock(path string) (func(), error) {
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("pid %d on %s at %s", os.Getpid(), host, time.Now().UTC().Format(time.RFC3339))
+
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.WriteString(owner)
+			f.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+
+			return func() { os.Remove(path) }, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if ok, err := fsBreakStaleLock(path); err != nil {
+			return nil, err
+		} else if ok {
+			continue
+		}
+
+		if i == fsLockAttempts {
+			holder, _ := ioutil.ReadFile(path)
+			return nil, fmt.Errorf("'%s' is held (by %s); delete it if nothing is writing", path, holder)
+		}
+
+		time.Sleep(fsLockDelay)
+	}
+}
+
+// Removes a lock file older than fsLockStale, returning whether it did. The
+// lock is renamed out of the way first and removed only if it's still the
+// one found stale, so that of several writers taking it over at once, none
+// removes a lock another has just taken.
+func fsBreakStaleLock(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	} else if time.Since(info.ModTime()) < fsLockStale {
+		return false, nil
+	}
+
+	holder, _ := ioutil.ReadFile(path)
+
+	suffix, err := newUploadID()
+	if err != nil {
+		return false, err
+	}
+
+	stale := path + "." + suffix
+	if err := os.Rename(path, stale); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if info, err := os.Stat(stale); err == nil && time.Since(info.ModTime()) < fsLockStale {
+		// someone else took it over in between; give it back unless it's
+		// been taken again since
+		os.Link(stale, path)
+		os.Remove(stale)
+		return false, nil
+	}
+
+	os.Remove(stale)
+
+	log.WithFields(log.Fields{
+		"path":   path,
+		"holder": string(holder),
+	}).Warn("took over stale lock")
+
+	return true, nil
+}
+
+// Makes a directory, if needs be, and creates a file in it with create. Once
+// the file's there, the directory stays; until then, deleteBlob may prune it
+// as empty, in which case it's made again.
+func fsCreateInDir(dir string, create func(dir string) error) error {
+	for i := 0; ; i++ {
+		// a parent made here can be pruned before its child is, too
+		err := os.MkdirAll(dir, os.ModeDir|0755)
+		if err == nil {
+			err = create(dir)
+		}
+
+		if !os.IsNotExist(err) || i == fsMkdirAttempts {
+			return err
+		}
+	}
+}
+
+// Deletes a blob, along with any directories it leaves empty
+func (fr *FilesystemRemote) deleteBlob(name string) error {
+	path, err := fr.pathOf(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// fails harmlessly as soon as a directory isn't empty
+	for dir := filepath.Dir(path); dir != fr.root && strings.HasPrefix(dir, fr.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Maps a blob name onto a path under the root, refusing to escape it
+func (fr *FilesystemRemote) pathOf(name string) (string, error) {
+	path := filepath.Join(fr.root, filepath.FromSlash(name))
+	if path != fr.root && !strings.HasPrefix(path, fr.root+string(filepath.Separator)) {
+		return "", ErrInvalidBlobName
+	}
+
+	return path, nil
+}
+
+// byBlobName implements sort.Interface for []blobInfo based on the Name field
+type byBlobName []blobInfo
+
+func (a byBlobName) Len() int           { return len(a) }
+func (a byBlobName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byBlobName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,65 @@
+package azdockertool
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilesystemListsBlobsInNameOrder(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{})
+	defer cleanup()
+
+	fr := remote.(*FilesystemRemote)
+	writeFiles(t, fr.root, map[string]string{
+		"refs/app.v2/latest": "",
+		"refs/app/v1":        "",
+		"refs/app/v10":       "",
+		"refs/app-x/v1":      "",
+	})
+
+	blobs, err := fr.listBlobs("refs/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, item := range blobs {
+		names = append(names, item.Name)
+	}
+
+	want := "refs/app-x/v1,refs/app.v2/latest,refs/app/v1,refs/app/v10"
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("listed %s, expected %s", got, want)
+	}
+}
+
+func TestFilesystemTakesOverStaleLocks(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{})
+	defer cleanup()
+
+	fr := remote.(*FilesystemRemote)
+	lock := filepath.Join(fr.root, "refs", "app", fsTempPrefix+"v1.lock")
+	writeFiles(t, fr.root, map[string]string{
+		"refs/app/" + fsTempPrefix + "v1.lock": "pid 1 on nowhere",
+	})
+
+	then := time.Now().Add(-2 * fsLockStale)
+	if err := os.Chtimes(lock, then, then); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fr.putBlobIfMatch("refs/app/v1", []byte("id"), ""); err != nil {
+		t.Fatalf("expected the stale lock to be taken over, got %v", err)
+	}
+
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("expected the lock to be released, got %v", err)
+	}
+
+	if err := fr.putBlobIfMatch("refs/app/v1", []byte("id"), ""); err != errPreconditionFailed {
+		t.Errorf("expected the tag to exist now, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package azdockertool
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// Deletes every image and layer blob that no tag can reach.
+//
+// The mark phase walks refs/ -> images/{id}/manifest.json -> layers/{id} (or
+// blobs/sha256/{digest}); any failure to read a tag or manifest aborts the
+// collection rather than risk sweeping something live. The sweep phase leaves
+// unmarked blobs modified within the grace period alone, since they probably
+// belong to a push that hasn't written its tags yet. Links to layer blobs that
+// aren't marked go too, as do abandoned uploads.
+//
+// The tags are marked again just before the sweep deletes anything, but a
+// push that found an old, unreferenced layer already there (and so didn't
+// send it) can still lose it if its tag lands after that; run gc when nothing
+// is pushing, or pull such images again after a gc that overlapped a push.
+func (l *layout) GC(grace time.Duration, dryRun bool) (*GCResult, error) {
+	perms := "rl"
+	if !dryRun {
+		perms += "d"
+	}
+
+	if err := l.checkPermissions("gc", perms); err != nil {
+		return nil, err
+	}
+
+	images, layers, err := l.mark()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &GCResult{
+		MarkedImages: len(images),
+		MarkedLayers: len(layers),
+		DryRun:       dryRun,
+	}
+
+	if l.config.Verbose {
+		log.WithFields(log.Fields{
+			"images": res.MarkedImages,
+			"layers": res.MarkedLayers,
+		}).Info("completed mark phase")
+	}
+
+	cutoff := time.Now().Add(-grace)
+
+	// whether a blob is reachable from the tags as last marked
+	live := func(name string) bool {
+		switch {
+		case strings.HasPrefix(name, manifestSearchPrefix):
+			id, _, ok := splitObjectPath(manifestSearchPrefix, name)
+			return !ok || images[id]
+		case strings.HasPrefix(name, layerSearchPrefix):
+			id, _, ok := splitObjectPath(layerSearchPrefix, name)
+			return !ok || layers[id]
+		case strings.HasPrefix(name, blobSearchPrefix):
+			// a content addressed blob is either an image config or a layer
+			id := ID(strings.TrimPrefix(name, blobSearchPrefix))
+			return images[id] || layers[id]
+		case strings.HasPrefix(name, linkSearchPrefix):
+			// links/{layer id}/{digest} lives as long as the blob it names
+			_, digest, ok := splitObjectPath(linkSearchPrefix, name)
+			return !ok || layers[ID(digest)]
+		}
+
+		// abandoned uploads
+		return false
+	}
+
+	prefixes := []string{manifestSearchPrefix, layerSearchPrefix, blobSearchPrefix, linkSearchPrefix, uploadSearchPrefix}
+	for _, prefix := range prefixes {
+		blobs, err := l.store.listBlobs(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range blobs {
+			if live(item.Name) {
+				continue
+			}
+
+			if item.LastModified.IsZero() || item.LastModified.After(cutoff) {
+				res.Retained = append(res.Retained, item.Name)
+				continue
+			}
+
+			res.Deleted = append(res.Deleted, item.Name)
+		}
+	}
+
+	if dryRun {
+		return res, nil
+	}
+
+	// a push may have tagged an image that reuses old, unreachable layers
+	// since the mark phase; mark again, and spare whatever that reaches
+	images, layers, err = l.mark()
+	if err != nil {
+		return nil, err
+	}
+
+	doomed := res.Deleted
+	res.Deleted = nil
+
+	for _, name := range doomed {
+		if live(name) {
+			res.Retained = append(res.Retained, name)
+		} else {
+			res.Deleted = append(res.Deleted, name)
+		}
+	}
+
+	for _, name := range res.Deleted {
+		if err := l.store.deleteBlob(name); err != nil {
+			log.WithFields(log.Fields{
+				"path": name,
+			}).Error("failed to delete blob")
+			return nil, err
+		}
+
+		if l.config.Verbose {
+			log.WithFields(log.Fields{
+				"path": name,
+			}).Info("deleted blob")
+		}
+	}
+
+	return res, nil
+}
+
+// Finds every image and layer reachable from a tag
+func (l *layout) mark() (images, layers map[ID]bool, err error) {
+	images = make(map[ID]bool)
+	layers = make(map[ID]bool)
+
+	refs, err := l.store.listBlobs(imageSearchPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, item := range refs {
+		id, err := l.readRef(item.Name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read tag '%s': %v", item.Name, err)
+		}
+
+		if images[id] {
+			continue
+		}
+
+		images[id] = true
+
+		m, err := l.getManifest(fmt.Sprintf("images/%s/manifest.json", id))
+		if isNotFound(err) {
+			log.WithFields(log.Fields{
+				"path":     item.Name,
+				"image id": string(id),
+			}).Warn("tag points at an image without a manifest")
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("could not read manifest of image '%s': %v", id.Short(), err)
+		}
+
+		for _, lid := range m.LayerIds() {
+			layers[lid] = true
+		}
+	}
+
+	return images, layers, nil
+}
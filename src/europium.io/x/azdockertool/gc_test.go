@@ -0,0 +1,63 @@
+package azdockertool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writes files under a directory, creating their parents
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, body := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGCReadsTagsWrittenByOtherTools(t *testing.T) {
+	root, err := ioutil.TempDir("", "azdockertool-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(root)
+
+	img := strings.Repeat("a", 64)
+	lid := strings.Repeat("b", 64)
+
+	writeFiles(t, root, map[string]string{
+		"refs/app/v1":                         fmt.Sprintf("sha256:%s\n", img),
+		"images/" + img + "/manifest.json":    fmt.Sprintf(`[{"Config":"%s.json","RepoTags":["app:v1"],"Layers":["%s/layer.tar"]}]`, img, lid),
+		"images/" + img + "/" + img + ".json": "{}",
+		"layers/" + lid + "/VERSION":          "1.0",
+		"layers/" + lid + "/json":             "{}",
+		"layers/" + lid + "/layer.tar":        "layer",
+	})
+
+	remote, err := NewFilesystemRemote(&Config{Type: RemoteTypeFilesystem, Path: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := remote.GC(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Deleted) != 0 {
+		t.Errorf("expected nothing to be collected, got %v", res.Deleted)
+	}
+
+	if res.MarkedImages != 1 || res.MarkedLayers != 1 {
+		t.Errorf("expected 1 image and 1 layer marked, got %d and %d", res.MarkedImages, res.MarkedLayers)
+	}
+}
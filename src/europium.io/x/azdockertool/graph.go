@@ -0,0 +1,341 @@
+package azdockertool
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	layerSearchPrefix    string = "layers/"
+	manifestSearchPrefix string = "images/"
+)
+
+// the legacy descriptor at layers/{id}/json
+type layer struct {
+	Id     string `json:"id"`
+	Parent string `json:"parent"`
+}
+
+// Builds the parent/child DAG of every layer, image and tag in the container;
+// unreadable layer descriptors, manifests and tags are skipped with a warning
+func (l *layout) Graph() (*LayerGraph, error) {
+	return l.graph(false)
+}
+
+// Builds the graph; strictly, a manifest or tag that can't be read fails it
+// instead, for callers that delete whatever it shows to be unreferenced
+func (l *layout) graph(strict bool) (*LayerGraph, error) {
+	g := newLayerGraph()
+
+	// layers first, so that their own parent pointers win over manifest order
+	blobs, err := l.store.listBlobs(layerSearchPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range blobs {
+		id, name, ok := splitObjectPath(layerSearchPrefix, item.Name)
+		if !ok || name != "json" {
+			continue
+		}
+
+		desc := &layer{}
+		if err := l.getJSON(item.Name, desc); err != nil {
+			log.WithFields(log.Fields{
+				"path":   item.Name,
+				"reason": err.Error(),
+			}).Warn("skipping unreadable layer descriptor")
+			g.layer(id)
+			continue
+		}
+
+		g.layer(id)
+		g.link(ID(desc.Parent), id)
+	}
+
+	// then every image manifest
+	blobs, err = l.store.listBlobs(manifestSearchPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range blobs {
+		id, name, ok := splitObjectPath(manifestSearchPrefix, item.Name)
+		if !ok || name != "manifest.json" {
+			continue
+		}
+
+		m, err := l.getManifest(item.Name)
+		if err != nil && strict {
+			return nil, fmt.Errorf("could not read manifest of image '%s': %v", id.Short(), err)
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"path":   item.Name,
+				"reason": err.Error(),
+			}).Warn("skipping unreadable image manifest")
+			continue
+		}
+
+		g.addImage(id, m.LayerIds())
+	}
+
+	// and finally the tags
+	refs, err := l.images(strict)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range refs {
+		g.addRef(ref)
+	}
+
+	g.normalize()
+
+	return g, nil
+}
+
+// LayerNode is a single layer in the remote, linked to its parent and children
+type LayerNode struct {
+	Id       ID
+	Parent   ID
+	Children []ID
+	Images   []ID // images whose topmost layer is this one
+}
+
+// ImageNode is a single image in the remote, along with its layers (base first)
+// and the tags pointing at it
+type ImageNode struct {
+	Id     ID
+	Layers []ID
+	Tags   []string
+}
+
+// LayerGraph is the parent/child DAG of every layer and image in the remote
+type LayerGraph struct {
+	Layers map[ID]*LayerNode
+	Images map[ID]*ImageNode
+	Refs   []*ImageInfo
+}
+
+func newLayerGraph() *LayerGraph {
+	return &LayerGraph{
+		Layers: make(map[ID]*LayerNode),
+		Images: make(map[ID]*ImageNode),
+	}
+}
+
+// returns the node for a layer, creating it if it hasn't been seen yet
+func (g *LayerGraph) layer(id ID) *LayerNode {
+	node, ok := g.Layers[id]
+	if !ok {
+		node = &LayerNode{Id: id}
+		g.Layers[id] = node
+	}
+
+	return node
+}
+
+// records that child descends from parent; the first parent seen wins
+func (g *LayerGraph) link(parent, child ID) {
+	if parent == "" || parent == child {
+		return
+	}
+
+	c := g.layer(child)
+	if c.Parent != "" {
+		return
+	}
+
+	c.Parent = parent
+	g.layer(parent).Children = append(g.layer(parent).Children, child)
+}
+
+// adds an image and its manifest layers, linking each layer to the one below it
+func (g *LayerGraph) addImage(id ID, layers []ID) {
+	img := &ImageNode{Id: id, Layers: layers}
+	g.Images[id] = img
+
+	for i, l := range layers {
+		g.layer(l)
+		if i > 0 {
+			g.link(layers[i-1], l)
+		}
+	}
+
+	if n := len(layers); n > 0 {
+		top := g.layer(layers[n-1])
+		top.Images = append(top.Images, id)
+	}
+}
+
+// adds a tag, attaching it to its image when the image is known
+func (g *LayerGraph) addRef(ref *ImageInfo) {
+	g.Refs = append(g.Refs, ref)
+
+	if img, ok := g.Images[ref.Id]; ok {
+		img.Tags = append(img.Tags, fmt.Sprintf("%s:%s", ref.Repository, ref.Tag))
+	}
+}
+
+// sorts everything so that output is stable between runs
+func (g *LayerGraph) normalize() {
+	for _, node := range g.Layers {
+		sortIds(node.Children)
+		sortIds(node.Images)
+	}
+
+	for _, img := range g.Images {
+		sort.Strings(img.Tags)
+	}
+
+	sort.Sort(ByRepositoryThenTag(g.Refs))
+}
+
+// Roots returns the base layers of the graph (layers without a parent)
+func (g *LayerGraph) Roots() []*LayerNode {
+	var ids []ID
+	for id, node := range g.Layers {
+		if node.Parent == "" || g.Layers[node.Parent] == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	sortIds(ids)
+
+	roots := make([]*LayerNode, 0, len(ids))
+	for _, id := range ids {
+		roots = append(roots, g.Layers[id])
+	}
+
+	return roots
+}
+
+// WriteTree prints the graph as an indented tree, from base layers upwards.
+// Layers whose parents lead round in a cycle (which only corrupt layer json
+// can describe) have no base to hang from; they're reported as an error once
+// the rest is printed.
+func (g *LayerGraph) WriteTree(w io.Writer) error {
+	seen := make(map[ID]bool)
+
+	roots := g.Roots()
+	for i, root := range roots {
+		if err := g.writeTreeNode(w, root, "", i == len(roots)-1, seen); err != nil {
+			return err
+		}
+	}
+
+	var cycle []ID
+	for id := range g.Layers {
+		if !seen[id] {
+			cycle = append(cycle, id)
+		}
+	}
+
+	if len(cycle) > 0 {
+		sortIds(cycle)
+		return fmt.Errorf("layer '%s' is its own ancestor; its layer json may be corrupt", cycle[0].Short())
+	}
+
+	return nil
+}
+
+func (g *LayerGraph) writeTreeNode(w io.Writer, node *LayerNode, indent string, last bool, seen map[ID]bool) error {
+	if seen[node.Id] {
+		return fmt.Errorf("layer '%s' is its own ancestor; its layer json may be corrupt", node.Id.Short())
+	}
+
+	seen[node.Id] = true
+
+	branch, next := "├─", "│ "
+	if last {
+		branch, next = "└─", "  "
+	}
+
+	line := fmt.Sprintf("%s%s%s", indent, branch, node.Id.Short())
+	for _, id := range node.Images {
+		line += fmt.Sprintf(" Image: %s", id.Short())
+		if img, ok := g.Images[id]; ok && len(img.Tags) > 0 {
+			line += fmt.Sprintf(" Tags: %s", strings.Join(img.Tags, ", "))
+		}
+	}
+
+	if _, err := fmt.Fprintln(w, line); err != nil {
+		return err
+	}
+
+	for i, id := range node.Children {
+		child := g.Layers[id]
+		if err := g.writeTreeNode(w, child, indent+next, i == len(node.Children)-1, seen); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteGraphviz prints the graph in DOT format, with tags as labelled roots
+// pointing at their images, images pointing at their topmost layer, and each
+// layer pointing at its parent
+func (g *LayerGraph) WriteGraphviz(w io.Writer) error {
+	var lines []string
+	emit := func(format string, a ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, a...))
+	}
+
+	emit("digraph layers {")
+	emit("  rankdir=TB;")
+	emit("  node [shape=box, fontname=monospace];")
+
+	for _, ref := range g.Refs {
+		name := fmt.Sprintf("%s:%s", ref.Repository, ref.Tag)
+		emit("  %q [label=%q, shape=ellipse, style=filled, fillcolor=lightblue];", "ref:"+name, name)
+		emit("  %q -> %q;", "ref:"+name, "image:"+ref.Id.String())
+	}
+
+	var images []ID
+	for id := range g.Images {
+		images = append(images, id)
+	}
+	sortIds(images)
+
+	for _, id := range images {
+		img := g.Images[id]
+		emit("  %q [label=%q, shape=box, style=rounded];", "image:"+id.String(), "image "+string(id.Short()))
+		if n := len(img.Layers); n > 0 {
+			emit("  %q -> %q;", "image:"+id.String(), "layer:"+img.Layers[n-1].String())
+		}
+	}
+
+	var layers []ID
+	for id := range g.Layers {
+		layers = append(layers, id)
+	}
+	sortIds(layers)
+
+	for _, id := range layers {
+		node := g.Layers[id]
+		emit("  %q [label=%q];", "layer:"+id.String(), string(id.Short()))
+		if node.Parent != "" {
+			emit("  %q -> %q;", "layer:"+id.String(), "layer:"+node.Parent.String())
+		}
+	}
+
+	emit("}")
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+func sortIds(ids []ID) {
+	sort.Sort(byId(ids))
+}
+
+// byId implements sort.Interface for []ID
+type byId []ID
+
+func (a byId) Len() int           { return len(a) }
+func (a byId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byId) Less(i, j int) bool { return a[i] < a[j] }
@@ -0,0 +1,25 @@
+package azdockertool
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteTreeReportsCycles(t *testing.T) {
+	g := newLayerGraph()
+	g.addImage("base", []ID{"base"})
+	g.link("a", "b")
+	g.link("b", "a")
+	g.normalize()
+
+	var buf bytes.Buffer
+	err := g.WriteTree(&buf)
+	if err == nil || !strings.Contains(err.Error(), "own ancestor") {
+		t.Fatalf("expected a cycle to be reported, got %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "base") {
+		t.Errorf("expected the rest of the tree to be printed, got %q", buf.String())
+	}
+}
@@ -1,38 +1,44 @@
 package azdockertool
 
 import (
-	sdk "github.com/Azure/azure-sdk-for-go/storage"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"sort"
 	"strings"
-	"time"
 )
 
 const (
 	imageSearchPrefix string = "refs/"
-	azureDateLayout   string = time.RFC1123
 )
 
-func (ar *absremote) Images() ([]*ImageInfo, error) {
+func (l *layout) Images() ([]*ImageInfo, error) {
+	return l.images(false)
+}
+
+// Lists the tags; strictly, a tag that can't be read fails the listing
+// instead of being skipped
+func (l *layout) images(strict bool) ([]*ImageInfo, error) {
 	var coll []*ImageInfo
 
-	// call azure
-	res, err := ar.blobStorage.ListBlobs(ar.config.Container, sdk.ListBlobsParameters{Prefix: imageSearchPrefix})
+	// list the tags
+	blobs, err := l.store.listBlobs(imageSearchPrefix)
 	if err != nil {
 		return nil, err
 	}
 
-	if ar.config.Verbose {
+	if l.config.Verbose {
 		log.WithFields(log.Fields{
-			"count": len(res.Blobs),
+			"count": len(blobs),
 		}).Info("found matching images")
 	}
 
 	// process the response
-	for _, item := range res.Blobs {
+	for _, item := range blobs {
 
-		id, err := ar.GetBlobAsString(item.Name)
-		if err != nil {
+		id, err := l.readRef(item.Name)
+		if err != nil && strict {
+			return nil, fmt.Errorf("could not read tag '%s': %v", item.Name, err)
+		} else if err != nil {
 			log.WithFields(log.Fields{
 				"path": item.Name,
 			}).Warn("skipping due to missing image pointer")
@@ -54,17 +60,7 @@ func (ar *absremote) Images() ([]*ImageInfo, error) {
 		tag := parts[n-1]
 		img := strings.Join(parts[:(n-1)], "/")
 
-		modified, err := time.Parse(azureDateLayout, item.Properties.LastModified)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"path":         item.Name,
-				"id":           id,
-				"LastModified": item.Properties.LastModified,
-			}).Warn("skipping due to malformed last modified")
-			continue
-		}
-
-		coll = append(coll, &ImageInfo{img, tag, modified, item.Name, ID(id)})
+		coll = append(coll, &ImageInfo{img, tag, item.LastModified, item.Name, id})
 	}
 
 	// sort, because we aren't monsters
@@ -73,6 +69,23 @@ func (ar *absremote) Images() ([]*ImageInfo, error) {
 	return coll, nil
 }
 
+// Reads the image ID a tag names
+func (l *layout) readRef(name string) (ID, error) {
+	body, err := l.GetBlobAsString(name)
+	if err != nil {
+		return "", err
+	}
+
+	return refID(body), nil
+}
+
+// Returns the image ID in the body of a tag. Tags are written as the bare hex
+// ID, but one written by hand or by another tool may carry a "sha256:" prefix
+// or a trailing newline.
+func refID(body string) ID {
+	return ID(ID(strings.TrimSpace(body)).String())
+}
+
 // ByRepositoryThenTag implements sort.Interface for []*ImageInfo based on the Name, Tag fields
 type ByRepositoryThenTag []*ImageInfo
 
@@ -0,0 +1,215 @@
+package azdockertool
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strconv"
+)
+
+// Rewrites every image in the legacy layout into the content addressed one.
+//
+// Each layer.tar is copied (server-side, where the store can) to
+// blobs/sha256/{digest}, and linked from links/{layer id}/ so that pushes in
+// either layout keep finding it. Then the image config goes to
+// blobs/sha256/{image id}, and manifest.json is replaced with one naming the
+// blobs, which is the point at which the image changes over. The legacy
+// layers/ of the migrated images are only deleted once every image has been
+// rewritten, so a migration that fails part way can simply be run again.
+//
+// Like rmi, this does not lock the container; push with the legacy layout
+// while it runs and the new image may lose its layers.
+func (l *layout) Migrate(dryRun bool) (*MigrateResult, error) {
+	perms := "rl"
+	if !dryRun {
+		perms += "wd"
+	}
+
+	if err := l.checkPermissions("migrate", perms); err != nil {
+		return nil, err
+	}
+
+	images, err := l.listObjects(manifestSearchPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &MigrateResult{DryRun: dryRun}
+	copied := make(map[ID]*descriptor)
+
+	for _, id := range sortedObjectIds(images) {
+		if !images[id]["manifest.json"] {
+			log.WithFields(log.Fields{
+				"image id": string(id),
+			}).Warn("skipping image without a manifest")
+			continue
+		}
+
+		m, err := l.getManifest(fmt.Sprintf("images/%s/manifest.json", id))
+		if err != nil {
+			return nil, fmt.Errorf("could not read manifest of image '%s': %v", id.Short(), err)
+		} else if m.cas != nil {
+			continue
+		}
+
+		if err := l.migrateImage(res, id, m, copied); err != nil {
+			return nil, fmt.Errorf("could not migrate image '%s': %v", id.Short(), err)
+		}
+
+		res.Images = append(res.Images, id)
+	}
+
+	// nothing needs the legacy layers any more
+	var stale []string
+	for _, lid := range res.Layers {
+		names, err := l.listBlobNames(fmt.Sprintf("layers/%s/", lid))
+		if err != nil {
+			return nil, err
+		}
+
+		stale = append(stale, names...)
+	}
+
+	res.Deleted = append(res.Deleted, stale...)
+	if dryRun {
+		return res, nil
+	}
+
+	for _, name := range stale {
+		if err := l.store.deleteBlob(name); err != nil {
+			log.WithFields(log.Fields{
+				"path":     name,
+				"rollback": false,
+			}).Error("failed to delete blob")
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// Copies an image's layers and config into blobs/sha256/, then replaces its
+// manifest, and deletes the config and repositories it no longer needs
+func (l *layout) migrateImage(res *MigrateResult, id ID, m *manifest, copied map[ID]*descriptor) error {
+	config, err := l.getBlob(fmt.Sprintf("images/%s/json", id))
+	if err != nil {
+		return err
+	} else if err := checkDigest(m.Config, imageDigest(id), bytesDigest(config)); err != nil {
+		return err
+	}
+
+	digests, err := layerDigests(m, config)
+	if err != nil {
+		return err
+	}
+
+	var descs []descriptor
+	for _, lid := range m.LayerIds() {
+		desc, ok := copied[lid]
+		if !ok {
+			res.Layers = append(res.Layers, lid)
+			if !res.DryRun {
+				if desc, err = l.migrateLayer(lid, digests[lid]); err != nil {
+					return err
+				}
+			}
+
+			copied[lid] = desc
+		}
+
+		if desc != nil {
+			descs = append(descs, *desc)
+		}
+	}
+
+	stale := []string{fmt.Sprintf("images/%s/json", id), fmt.Sprintf("images/%s/repositories", id)}
+	if res.DryRun {
+		res.Deleted = append(res.Deleted, stale...)
+		return nil
+	}
+
+	if err := l.putCASImage(id, config, descs); err != nil {
+		return err
+	}
+
+	for _, name := range stale {
+		if err := l.store.deleteBlob(name); err != nil {
+			return err
+		}
+
+		res.Deleted = append(res.Deleted, name)
+	}
+
+	return nil
+}
+
+// Copies a layer's layer.tar to the blob named by its digest, as stored, and
+// links the layer to it
+func (l *layout) migrateLayer(id ID, diffID string) (*descriptor, error) {
+	name := fmt.Sprintf("layers/%s/layer.tar", id)
+	blobs, err := l.store.listBlobs(name)
+	if err != nil {
+		return nil, err
+	} else if len(blobs) != 1 || blobs[0].Name != name {
+		return nil, fmt.Errorf("corrupt or incomplete layer '%s'", id.Short())
+	}
+
+	c, err := l.getLayerCompression(id)
+	if err != nil {
+		return nil, fmt.Errorf("layer '%s': %v", id.Short(), err)
+	}
+
+	digest, err := l.storedDigest(name)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &descriptor{MediaType: MediaTypeLayer, Size: blobs[0].Size, Digest: digest}
+	if c != nil {
+		desc.MediaType = layerMediaType(c.Codec)
+		desc.Annotations = map[string]string{uncompressedSizeAnnotation: strconv.FormatInt(c.Size, 10)}
+	} else if err := checkDigest(name, diffID, digest); err != nil {
+		return nil, err
+	}
+
+	exists, err := l.hasBlob(blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if err := l.duplicateBlob(name, blobPath(digest)); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := l.putLink(id, desc); err != nil {
+		return nil, err
+	}
+
+	if l.config.Verbose {
+		log.WithFields(log.Fields{
+			"layer id": string(id),
+			"digest":   digest,
+			"new":      !exists,
+		}).Info("migrated layer")
+	}
+
+	return desc, nil
+}
+
+// Returns the digest of a blob as stored: the one push recorded, if the store
+// keeps metadata, or else by hashing it
+func (l *layout) storedDigest(name string) (string, error) {
+	if ms, ok := l.store.(metadataStore); ok {
+		meta, err := ms.getBlobMetadata(name)
+		if err != nil {
+			return "", fmt.Errorf("could not read metadata of '%s': %v", name, err)
+		}
+
+		if digest := meta[digestMetadataKey]; digest != "" {
+			return digest, nil
+		}
+	}
+
+	return l.hashBlob(name, "")
+}
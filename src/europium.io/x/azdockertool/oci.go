@@ -0,0 +1,464 @@
+package azdockertool
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIConfig    = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	ociLayoutVersion = "1.0.0"
+
+	// annotations naming the image an index.json entry is
+	ociRefNameAnnotation   = "org.opencontainers.image.ref.name" // its tag
+	ociImageNameAnnotation = "io.containerd.image.name"          // its repository:tag
+)
+
+// the oci-layout file at the top of an OCI image layout
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// the index.json at the top of an OCI image layout
+type ociIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+// Streams an image from an OCI image layout, as `docker save` would write it,
+// to w, so that it can be pushed without Docker. The image is the one
+// index.json names repository (by its tag, or its full name), or else the only
+// one there is.
+func OCISave(dir, repository string, w io.Writer) error {
+	repo, tag := toRepositoryAndTag(repository)
+
+	var layout ociLayout
+	if err := readOCIFile(dir, "oci-layout", &layout); err != nil {
+		return err
+	} else if layout.ImageLayoutVersion == "" {
+		return fmt.Errorf("'%s' is not an OCI image layout", dir)
+	}
+
+	var index ociIndex
+	if err := readOCIFile(dir, "index.json", &index); err != nil {
+		return err
+	}
+
+	desc, err := findOCIManifest(&index, repo, tag)
+	if err != nil {
+		return err
+	} else if desc.MediaType == MediaTypeOCIIndex {
+		return fmt.Errorf("'%s' is an index of images (multi-platform?), which isn't supported", desc.Digest)
+	}
+
+	b, err := readOCIBlob(dir, desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	var m casManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("could not read manifest '%s': %v", desc.Digest, err)
+	} else if m.SchemaVersion != 2 || m.Config.Digest == "" {
+		return fmt.Errorf("unsupported manifest '%s' (schema version %d)", desc.Digest, m.SchemaVersion)
+	}
+
+	config, err := readOCIBlob(dir, m.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	return writeManifestSave(w, repo, tag, &m, config, func(layer descriptor) (io.ReadCloser, error) {
+		codec, err := layerCodec(layer.MediaType)
+		if err != nil {
+			return nil, err
+		}
+
+		path, err := ociBlobPath(dir, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		return openOCILayer(path, codec)
+	})
+}
+
+// Writes an image, given its (OCI or schema 2) manifest and config, to w as
+// `docker save` would, tagged repo:tag, with each layer as openLayer
+// decompresses it. Layer IDs are made up from the layers beneath, much as
+// docker makes up its own, so the same layers always get the same IDs.
+func writeManifestSave(w io.Writer, repo, tag string, m *casManifest, config []byte, openLayer func(layer descriptor) (io.ReadCloser, error)) error {
+	var ic imageConfig
+	if err := json.Unmarshal(config, &ic); err != nil {
+		return fmt.Errorf("could not read image config: %v", err)
+	} else if len(ic.RootFS.DiffIDs) != len(m.Layers) {
+		return fmt.Errorf("image config lists %d layers, but the manifest has %d", len(ic.RootFS.DiffIDs), len(m.Layers))
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	id := ID(m.Config.Digest).String()
+
+	var layers []string
+	var parent string
+	for i, layer := range m.Layers {
+		lid := ID(bytesDigest([]byte(parent + " " + ic.RootFS.DiffIDs[i]))).String()
+
+		err := tw.WriteHeader(&tar.Header{
+			Name:     lid + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  now,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		v1, err := json.Marshal(map[string]string{"id": lid, "parent": parent})
+		if err != nil {
+			return err
+		}
+
+		if err := writeLoadArchiveFile(tw, lid+"/VERSION", []byte("1.0"), now); err != nil {
+			return err
+		}
+
+		if err := writeLoadArchiveFile(tw, lid+"/json", v1, now); err != nil {
+			return err
+		}
+
+		if err := writeManifestSaveLayer(tw, lid+"/layer.tar", layer, openLayer, now); err != nil {
+			return err
+		}
+
+		layers = append(layers, lid+"/layer.tar")
+		parent = lid
+	}
+
+	name := fmt.Sprintf("%s:%s", repo, tag)
+	saveManifest, err := json.Marshal([]*manifest{{Config: id + ".json", RepoTags: []string{name}, Layers: layers}})
+	if err != nil {
+		return err
+	}
+
+	repositories, err := json.Marshal(map[string]map[string]string{repo: {tag: id}})
+	if err != nil {
+		return err
+	}
+
+	root := map[string][]byte{
+		id + ".json":    config,
+		"manifest.json": saveManifest,
+		"repositories":  repositories,
+	}
+
+	for _, name := range sortedNames(root) {
+		if err := writeLoadArchiveFile(tw, name, root[name], now); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// Writes a layer into a save as its layer.tar. Unless its descriptor says how
+// big that is, the layer is read through once first to find out.
+func writeManifestSaveLayer(tw *tar.Writer, name string, layer descriptor, openLayer func(layer descriptor) (io.ReadCloser, error), modTime time.Time) error {
+	size, ok := layerTarSize(layer)
+	if !ok {
+		f, err := openLayer(layer)
+		if err != nil {
+			return err
+		}
+
+		size, err = io.Copy(ioutil.Discard, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := openLayer(layer)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return writeLoadArchiveStream(tw, name, f, size, modTime)
+}
+
+// Returns the size of a layer's layer.tar as its descriptor gives it: its own
+// size, if it isn't compressed, or else the size annotated when it was
+// compressed, if it was by a push
+func layerTarSize(layer descriptor) (int64, bool) {
+	if codec, err := layerCodec(layer.MediaType); err == nil && codec == "" {
+		return layer.Size, true
+	}
+
+	size, err := strconv.ParseInt(layer.Annotations[uncompressedSizeAnnotation], 10, 64)
+	return size, err == nil && size >= 0
+}
+
+// Opens a layer blob, decompressing it with codec, if given
+func openOCILayer(path, codec string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil || codec == "" {
+		return f, err
+	}
+
+	return decompressor(path, codec, f)
+}
+
+// Returns the index.json entry for repository:tag, or the only entry, if
+// there's just the one. Entries without a full name, as other tools may write
+// them, are matched by their tag alone.
+func findOCIManifest(index *ociIndex, repo, tag string) (*descriptor, error) {
+	var found, tagged []*descriptor
+	for i, desc := range index.Manifests {
+		name, ref := desc.Annotations[ociImageNameAnnotation], desc.Annotations[ociRefNameAnnotation]
+		if name == repo+":"+tag {
+			found = append(found, &index.Manifests[i])
+		} else if name == "" && (ref == tag || ref == repo+":"+tag) {
+			tagged = append(tagged, &index.Manifests[i])
+		}
+	}
+
+	if len(found) == 0 {
+		found = tagged
+	}
+
+	if len(found) == 0 && len(index.Manifests) == 1 {
+		return &index.Manifests[0], nil
+	} else if len(found) == 0 {
+		return nil, ErrNoSuchImage
+	} else if len(found) > 1 {
+		return nil, ErrMultipleResults
+	}
+
+	return found[0], nil
+}
+
+// Writes an image, from a stream as `docker save` writes it, into an OCI
+// image layout, creating the layout if needs be. Layers are stored as they
+// come, uncompressed. The image is added to index.json under its
+// repository:tag, replacing whatever had that name before.
+func OCILoad(dir string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return err
+	}
+
+	layers := make(map[string]*descriptor) // by path in the save
+	root := make(map[string][]byte)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		prefix, base := path.Split(name)
+		if prefix != "" && base == "layer.tar" {
+			if layers[name], err = writeOCIBlob(dir, tr, MediaTypeOCILayer); err != nil {
+				return err
+			}
+		} else if prefix == "" {
+			if hdr.Size > maxSaveMetadataSize {
+				return fmt.Errorf("'%s' is too large to be part of a save", name)
+			}
+
+			if root[base], err = ioutil.ReadAll(tr); err != nil {
+				return err
+			}
+		}
+	}
+
+	m, err := decodeManifest(bytes.NewReader(root["manifest.json"]))
+	if root["manifest.json"] == nil || err != nil {
+		return fmt.Errorf("could not read the manifest.json of the save: %v", err)
+	} else if root[m.Config] == nil {
+		return fmt.Errorf("the save is missing its image config")
+	}
+
+	config, err := writeOCIBlob(dir, bytes.NewReader(root[m.Config]), MediaTypeOCIConfig)
+	if err != nil {
+		return err
+	}
+
+	om := &casManifest{SchemaVersion: 2, MediaType: MediaTypeOCIManifest, Config: *config}
+	for _, name := range m.Layers {
+		layer, ok := layers[path.Clean(name)]
+		if !ok {
+			return fmt.Errorf("the save is missing '%s'", name)
+		}
+
+		om.Layers = append(om.Layers, *layer)
+	}
+
+	b, err := json.Marshal(om)
+	if err != nil {
+		return err
+	}
+
+	desc, err := writeOCIBlob(dir, bytes.NewReader(b), MediaTypeOCIManifest)
+	if err != nil {
+		return err
+	}
+
+	var name string
+	if len(m.RepoTags) > 0 {
+		repo, tag := toRepositoryAndTag(m.RepoTags[0])
+		name = fmt.Sprintf("%s:%s", repo, tag)
+		desc.Annotations = map[string]string{
+			ociRefNameAnnotation:   tag,
+			ociImageNameAnnotation: name,
+		}
+	}
+
+	// index.json last, since it's what makes the image visible
+	if err := writeOCIFile(dir, "oci-layout", &ociLayout{ImageLayoutVersion: ociLayoutVersion}); err != nil {
+		return err
+	}
+
+	index := &ociIndex{SchemaVersion: 2, MediaType: MediaTypeOCIIndex}
+	if err := readOCIFile(dir, "index.json", index); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// another repository's image with the same tag, or this image under
+	// another name, stays
+	var manifests []descriptor
+	for _, other := range index.Manifests {
+		if other.Annotations[ociImageNameAnnotation] == name && (name != "" || other.Digest == desc.Digest) {
+			continue
+		}
+
+		manifests = append(manifests, other)
+	}
+
+	index.Manifests = append(manifests, *desc)
+	return writeOCIFile(dir, "index.json", index)
+}
+
+// Returns where a blob of an OCI image layout is
+func ociBlobPath(dir, digest string) (string, error) {
+	hash := strings.TrimPrefix(digest, "sha256:")
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 || hash == digest {
+		return "", fmt.Errorf("unsupported digest '%s'", digest)
+	}
+
+	return filepath.Join(dir, "blobs", "sha256", hash), nil
+}
+
+// Reads a blob of an OCI image layout, checking it against its digest
+func readOCIBlob(dir, digest string) ([]byte, error) {
+	path, err := ociBlobPath(dir, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	} else if err := checkDigest(path, digest, bytesDigest(b)); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Writes a blob into an OCI image layout, hashing it on the way
+func writeOCIBlob(dir string, r io.Reader, mediaType string) (*descriptor, error) {
+	f, err := ioutil.TempFile(filepath.Join(dir, "blobs", "sha256"), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(f.Name())
+
+	d := newDigestingReader(f.Name(), r, "")
+	n, err := io.Copy(f, d)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := ociBlobPath(dir, d.Digest())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return nil, err
+	}
+
+	return &descriptor{MediaType: mediaType, Size: n, Digest: d.Digest()}, nil
+}
+
+func readOCIFile(dir, name string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("could not read '%s': %v", name, err)
+	}
+
+	return nil
+}
+
+// Writes a file at the top of an OCI image layout, replacing it in one go
+func writeOCIFile(dir, name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(dir, name))
+}
@@ -0,0 +1,72 @@
+package azdockertool
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestOCILoadReplacesOnlyTheSameName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azdockertool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// the same tag in two repositories, the same image under two tags, and
+	// then a tag loaded again with another image
+	loads := []struct{ repoTag, content string }{
+		{"other/app:v1", "other"},
+		{"team/app:v1", "old"},
+		{"team/app:latest", "new"},
+		{"team/app:v1", "new"},
+	}
+
+	ids := make(map[string]ID)
+	for _, load := range loads {
+		id, save := makeSave(t, load.repoTag, load.content)
+		if err := OCILoad(dir, bytes.NewReader(save)); err != nil {
+			t.Fatalf("could not load %s: %v", load.repoTag, err)
+		}
+
+		ids[load.repoTag] = id
+	}
+
+	var index ociIndex
+	if err := readOCIFile(dir, "index.json", &index); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, desc := range index.Manifests {
+		names = append(names, desc.Annotations[ociImageNameAnnotation])
+	}
+
+	sort.Strings(names)
+	if len(names) != 3 || names[0] != "other/app:v1" || names[1] != "team/app:latest" || names[2] != "team/app:v1" {
+		t.Fatalf("index.json names %v", names)
+	}
+
+	// and each is saved as the image last loaded under that name
+	for repoTag, id := range ids {
+		var buf bytes.Buffer
+		if err := OCISave(dir, repoTag, &buf); err != nil {
+			t.Fatalf("could not save %s: %v", repoTag, err)
+		}
+
+		files, err := readTar(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := decodeManifest(bytes.NewReader(files["manifest.json"]))
+		if err != nil {
+			t.Fatal(err)
+		} else if m.ImageId() != string(id) {
+			t.Errorf("%s saved as image %s, loaded as %s", repoTag, ID(m.ImageId()).Short(), id.Short())
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package azdockertool
+
+import (
+	"sync"
+)
+
+// Calls fn for items 0 through count-1 using at most n goroutines. Once any
+// call fails no further items are started, stop is closed so that calls in
+// flight can give up early, and the first error is returned.
+func forEachParallel(n, count int, fn func(i int, stop <-chan struct{}) error) error {
+	if n < 1 {
+		n = 1
+	}
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	stop := make(chan struct{})
+	work := make(chan int)
+
+	for w := 0; w < n && w < count; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if stopped(stop) {
+					continue
+				}
+
+				if err := fn(i, stop); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(stop)
+					})
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < count; i++ {
+		select {
+		case work <- i:
+		case <-stop:
+			break dispatch
+		}
+	}
+
+	close(work)
+	wg.Wait()
+
+	return firstErr
+}
+
+// Returns whether stop has been closed
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -7,5 +7,17 @@ Container Structure
 layers/{LAYER_ID}/{VERSION, json, layer.tar}
 images/{IMAGE_ID}/{manifest.json, repositories, json}
 refs/{REPOSITORY}/{TAG}
+
+or, with the content addressed layout (see LayoutCAS):
+
+blobs/sha256/{DIGEST}
+links/{LAYER_ID}/{DIGEST}
+images/{IMAGE_ID}/manifest.json
+refs/{REPOSITORY}/{TAG}
+
+where each manifest.json names its config and layers by digest. In either
+layout, uploads/ holds blobs a push is still hashing, and blobs pushed over
+the registry API, as uploads/{UUID}/{OFFSET} chunks and then
+uploads/sha256/{DIGEST}, until their manifest arrives.
 */
 package azdockertool
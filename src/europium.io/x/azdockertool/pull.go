@@ -0,0 +1,494 @@
+package azdockertool
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retrieves an image from the remote and hands it to the importer as the
+// archive `docker save` (1.10+) would have written, ready for `docker load`.
+//
+// The archive is written as the blobs are downloaded, straight into the
+// importer; nothing is staged on disk. Up to config.Concurrency layers are
+// downloaded ahead of the one being written, and held in memory until their
+// turn; those big enough to be fetched in ranges stream instead. Every layer
+// is listed before anything is sent, so that a layer missing from the remote
+// fails the pull before the importer sees any of it. Compressed layers are
+// decompressed on the way. If a blob can't be read, or doesn't match its
+// digest, the importer's stream fails with that error.
+func (l *layout) Pull(query string, known func(id ID) (bool, error), importer func(r io.Reader) error) (*PullResult, error) {
+
+	// resolve the query to an image
+	root, repo, tag, err := l.resolveImage(query)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Image '%s' resolved to ID '%s'\n", query, root.Short())
+
+	// nothing to download if the Docker host already has it
+	done, err := known(root)
+	if err != nil {
+		return nil, err
+	} else if done {
+		return &PullResult{Id: root, Repository: repo, Tag: tag, Present: true}, nil
+	}
+
+	m, err := l.getManifest(fmt.Sprintf("images/%s/manifest.json", root))
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest of image '%s': %v", root.Short(), err)
+	}
+
+	// download the image config, which is what the image ID is a digest of
+	fmt.Println("Downloading image config from remote...")
+	config, err := l.getBlob(m.configBlob())
+	if err != nil {
+		return nil, err
+	} else if err := checkDigest(m.Config, imageDigest(root), bytesDigest(config)); err != nil {
+		return nil, err
+	}
+
+	// and which says what each layer.tar should hash to
+	digests, err := layerDigests(m, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// layers with the same content have the same ID in the content addressed
+	// layout, and only need sending once
+	var layers []*pulledLayer
+	seen := make(map[ID]bool)
+	for i, id := range m.LayerIds() {
+		if seen[id] {
+			continue
+		}
+
+		seen[id] = true
+
+		var layer *pulledLayer
+		if m.cas != nil {
+			layer, err = l.getPulledCASLayer(id, m.cas.Layers[i])
+		} else {
+			layer, err = l.getPulledLayer(id)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		layers = append(layers, layer)
+	}
+
+	// the manifest and repositories files `docker load` expects
+	m.RepoTags = nil
+	var repositories []byte
+	if repo != "" {
+		m.RepoTags = []string{fmt.Sprintf("%s:%s", repo, tag)}
+		repositories, err = json.Marshal(map[string]map[string]string{repo: {tag: root.String()}})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	loadManifest, err := json.Marshal([]*manifest{m})
+	if err != nil {
+		return nil, err
+	}
+
+	// send it all to the importer as it downloads
+	fmt.Println("Downloading layers from remote...")
+	pr, pw := io.Pipe()
+	imported := make(chan error, 1)
+	go func() {
+		err := importer(pr)
+		// stops the download if the importer gave up without reading it all
+		pr.CloseWithError(err)
+		imported <- err
+	}()
+
+	werr := l.writeLoadArchive(pw, layers, digests, map[string][]byte{
+		m.Config:        config,
+		"manifest.json": loadManifest,
+		"repositories":  repositories,
+	})
+	pw.CloseWithError(werr)
+	ierr := <-imported
+
+	// the importer's error, if writing only failed because it stopped
+	// reading; otherwise what stopped the download
+	if ierr != nil && (werr == nil || werr == ierr) {
+		return nil, ierr
+	} else if werr != nil {
+		return nil, werr
+	}
+
+	return &PullResult{Id: root, Repository: repo, Tag: tag}, nil
+}
+
+// pulledLayer is what Pull needs to know about a layer before sending it
+type pulledLayer struct {
+	id          ID
+	files       map[string]blobInfo // the blob each file of the layer is in
+	json        []byte
+	compression *layerCompression // nil if stored as docker saved it
+}
+
+// Lists a layer's blobs, and reads its json to find out how it is stored
+func (l *layout) getPulledLayer(id ID) (*pulledLayer, error) {
+	blobs, err := l.store.listBlobs(fmt.Sprintf("layers/%s/", id))
+	if err != nil {
+		return nil, err
+	} else if len(blobs) != len(layerFiles) {
+		return nil, fmt.Errorf("corrupt or incomplete layer '%s' (found %d of %d files)", id.Short(), len(blobs), len(layerFiles))
+	}
+
+	layer := &pulledLayer{id: id, files: make(map[string]blobInfo)}
+	for _, item := range blobs {
+		layer.files[path.Base(item.Name)] = item
+		if path.Base(item.Name) != "json" {
+			continue
+		}
+
+		layer.json, err = l.getVerified(item)
+		if err != nil {
+			return nil, err
+		}
+
+		layer.compression, err = readLayerCompression(layer.json)
+		if err != nil {
+			return nil, fmt.Errorf("layer '%s': %v", id.Short(), err)
+		}
+	}
+
+	return layer, nil
+}
+
+// Finds the blob of a layer in the content addressed layout. That's all of the
+// layer there is; `docker load` only reads the layer.tar of each layer that
+// manifest.json names.
+func (l *layout) getPulledCASLayer(id ID, desc descriptor) (*pulledLayer, error) {
+	name := blobPath(desc.Digest)
+	blobs, err := l.store.listBlobs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	layer := &pulledLayer{id: id, files: make(map[string]blobInfo)}
+	for _, item := range blobs {
+		if item.Name == name {
+			layer.files["layer.tar"] = item
+		}
+	}
+
+	if len(layer.files) == 0 {
+		return nil, fmt.Errorf("missing layer '%s'", id.Short())
+	}
+
+	codec, err := layerCodec(desc.MediaType)
+	if err != nil {
+		return nil, fmt.Errorf("layer '%s': %v", id.Short(), err)
+	} else if codec == "" {
+		return layer, nil
+	}
+
+	size, err := strconv.ParseInt(desc.Annotations[uncompressedSizeAnnotation], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("layer '%s' doesn't record its uncompressed size", id.Short())
+	}
+
+	layer.compression = &layerCompression{Codec: codec, Size: size}
+	return layer, nil
+}
+
+// Writes a `docker save` archive of the given layers and the files at the top
+// of it to w, decompressing each layer.tar and checking it against its digest
+// as it goes. Errors writing to w are returned as they are.
+func (l *layout) writeLoadArchive(w io.Writer, layers []*pulledLayer, digests map[ID]string, root map[string][]byte) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	prefetch := l.newLayerPrefetcher(layers, digests)
+	defer prefetch.Close()
+
+	for _, layer := range layers {
+		fetched := prefetch.take()
+		if fetched.err != nil {
+			return fetched.err
+		}
+
+		fmt.Printf("Pulling layer id '%s'\n", layer.id.Short())
+
+		err := tw.WriteHeader(&tar.Header{
+			Name:     layer.id.String() + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  now,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, file := range sortedFiles(layer.files) {
+			item := layer.files[file]
+			name := fmt.Sprintf("%s/%s", layer.id, file)
+
+			if file == "json" {
+				err = writeLoadArchiveFile(tw, name, layer.json, item.LastModified)
+			} else {
+				err = l.writeLoadArchiveBlob(tw, name, item, layer, fetched.files[file], digests)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range sortedNames(root) {
+		if root[name] == nil {
+			continue
+		}
+
+		if err := writeLoadArchiveFile(tw, name, root[name], now); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// Writes a file of a layer into the archive, from what was prefetched of it or
+// as it downloads. A layer.tar is decompressed if needs be, and checked against
+// the digest the image config gives it.
+func (l *layout) writeLoadArchiveBlob(tw *tar.Writer, name string, item blobInfo, layer *pulledLayer, fetched []byte, digests map[ID]string) error {
+	var raw io.ReadCloser
+	if fetched != nil {
+		raw = ioutil.NopCloser(bytes.NewReader(fetched))
+	} else {
+		var err error
+		raw, err = l.openVerified(item, layer.storedDigest(path.Base(name), digests))
+		if err != nil {
+			return err
+		}
+	}
+
+	c := layer.compression
+	if path.Base(name) != "layer.tar" || c == nil {
+		defer raw.Close()
+		return writeLoadArchiveStream(tw, name, raw, item.Size, item.LastModified)
+	}
+
+	zr, err := decompressor(item.Name, c.Codec, raw)
+	if err != nil {
+		raw.Close()
+		return err
+	}
+
+	src := newVerifyingReader(zr, blobInfo{Name: item.Name, Size: c.Size}, digests[layer.id])
+	defer src.Close()
+
+	return writeLoadArchiveStream(tw, name, src, c.Size, item.LastModified)
+}
+
+func writeLoadArchiveStream(tw *tar.Writer, name string, r io.Reader, size int64, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+func writeLoadArchiveFile(tw *tar.Writer, name string, b []byte, modTime time.Time) error {
+	return writeLoadArchiveStream(tw, name, bytes.NewReader(b), int64(len(b)), modTime)
+}
+
+// The digest a file of the layer is stored with, if the image config gives one
+func (layer *pulledLayer) storedDigest(file string, digests map[ID]string) string {
+	if file == "layer.tar" && layer.compression == nil {
+		return digests[layer.id]
+	}
+
+	return ""
+}
+
+// layerPrefetcher downloads the files of the layers Pull sends up to
+// config.Concurrency layers ahead of the one being written, so that an image of
+// many small layers doesn't wait on each download in turn. They're held in
+// memory until their layer's turn, so files big enough to be fetched in ranges
+// are left to stream then instead.
+type layerPrefetcher struct {
+	l       *layout
+	layers  []*pulledLayer
+	digests map[ID]string
+	ahead   int
+	next    int                   // the next layer to start downloading
+	pending []chan prefetchResult // in the order they're to be written
+	stop    chan struct{}
+}
+
+type prefetchResult struct {
+	files map[string][]byte // by file name; what isn't here is to be streamed
+	err   error
+}
+
+func (l *layout) newLayerPrefetcher(layers []*pulledLayer, digests map[ID]string) *layerPrefetcher {
+	ahead := l.config.Concurrency
+	if ahead < 1 {
+		ahead = 1
+	}
+
+	return &layerPrefetcher{l: l, layers: layers, digests: digests, ahead: ahead, stop: make(chan struct{})}
+}
+
+// Waits for the next layer's files, starting on those after it meanwhile
+func (p *layerPrefetcher) take() prefetchResult {
+	for p.next < len(p.layers) && len(p.pending) < p.ahead {
+		ch := make(chan prefetchResult, 1)
+		p.pending = append(p.pending, ch)
+		go p.fetch(p.layers[p.next], ch)
+		p.next++
+	}
+
+	res := <-p.pending[0]
+	p.pending = p.pending[1:]
+	return res
+}
+
+func (p *layerPrefetcher) fetch(layer *pulledLayer, ch chan<- prefetchResult) {
+	res := prefetchResult{files: make(map[string][]byte)}
+	defer func() { ch <- res }()
+
+	for _, file := range sortedFiles(layer.files) {
+		item := layer.files[file]
+		if file == "json" || item.Size >= rangedFetchThreshold {
+			continue
+		} else if stopped(p.stop) {
+			return
+		}
+
+		src, err := p.l.openVerified(item, layer.storedDigest(file, p.digests))
+		if err != nil {
+			res.err = err
+			return
+		}
+
+		res.files[file], err = ioutil.ReadAll(src)
+		src.Close()
+		if err != nil {
+			res.err = err
+			return
+		}
+	}
+}
+
+// Stops downloads that haven't started; those in flight are left to finish
+func (p *layerPrefetcher) Close() {
+	close(p.stop)
+}
+
+// Resolves a tag or (partial) image ID to an image; the repository and tag
+// are empty if it was an ID, since there's nothing to tag
+func (l *layout) resolveImage(query string) (ID, string, string, error) {
+	repo, tag := toRepositoryAndTag(query)
+	root, err := l.findLayerByImageAndTag(repo, tag)
+	if err == nil {
+		return root, repo, tag, nil
+	}
+
+	root, err = l.findLayerByHash(query)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return root, "", "", nil
+}
+
+// Returns a repository and a tag from an docker image ID
+func toRepositoryAndTag(image string) (repository string, tag string) {
+	s := strings.TrimPrefix(image, "sha256:")
+	a := strings.Split(s, ":")
+	if len(a) == 1 {
+		return a[0], "latest"
+	} else {
+		return a[0], a[1]
+	}
+}
+
+// Queries the tag index to find the corresponding image identifier, if any
+func (l *layout) findLayerByImageAndTag(image, tag string) (ID, error) {
+	query := fmt.Sprintf("refs/%s/%s", image, tag)
+	return l.readRef(query)
+}
+
+// Queries the full image store to locate an image by its (partial) identifier
+func (l *layout) findLayerByHash(hash string) (ID, error) {
+	// clean up what could be a completely unsafe mess
+	coll := strings.Split(hash, "/")
+	hash = strings.TrimPrefix(coll[0], "sha256:")
+	query := fmt.Sprintf("images/%s", hash)
+
+	// listing because we may have been given a partial hash
+	blobs, err := l.store.listBlobs(query)
+	if err != nil {
+		return "", err
+	}
+
+	// each image is several blobs, so count distinct ids
+	found := make(map[ID]bool)
+	for _, item := range blobs {
+		if id, _, ok := splitObjectPath(manifestSearchPrefix, item.Name); ok {
+			found[id] = true
+		}
+	}
+
+	if len(found) == 0 {
+		return "", ErrNoSuchImage
+	} else if len(found) > 1 {
+		return "", ErrMultipleResults
+	}
+
+	for id := range found {
+		return id, nil
+	}
+
+	return "", ErrNoSuchImage
+}
+
+func sortedFiles(files map[string]blobInfo) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func sortedNames(files map[string][]byte) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,274 @@
+package azdockertool
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeSave returns a tarball as `docker save` writes it, for an image whose
+// layers hold the given contents, base first, along with the image's ID
+func makeSave(t *testing.T, repoTag string, contents ...string) (ID, []byte) {
+	return makeTamperedSave(t, repoTag, nil, contents...)
+}
+
+// makeTamperedSave is makeSave, letting tamper change the files of the save
+// before they're written
+func makeTamperedSave(t *testing.T, repoTag string, tamper func(files map[string][]byte), contents ...string) (ID, []byte) {
+	files := make(map[string][]byte)
+
+	var layers, diffIDs []string
+	parent := ""
+	for i, c := range contents {
+		id := ID(bytesDigest([]byte(fmt.Sprintf("%s-%d-%s", repoTag, i, c)))).String()
+		desc, _ := json.Marshal(map[string]string{"id": id, "parent": parent})
+
+		files[id+"/VERSION"] = []byte("1.0")
+		files[id+"/json"] = desc
+		files[id+"/layer.tar"] = []byte(c)
+
+		layers = append(layers, id+"/layer.tar")
+		diffIDs = append(diffIDs, bytesDigest([]byte(c)))
+		parent = id
+	}
+
+	config, _ := json.Marshal(map[string]interface{}{
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+
+	id := ID(bytesDigest(config)).String()
+	files[id+".json"] = config
+
+	m, _ := json.Marshal([]map[string]interface{}{{"Config": id + ".json", "RepoTags": []string{repoTag}, "Layers": layers}})
+	files["manifest.json"] = m
+	files["repositories"] = []byte("{}")
+
+	if tamper != nil {
+		tamper(files)
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return ID(id), buf.Bytes()
+}
+
+// pushSave pushes an image with the given layer contents, returning its ID
+func pushSave(t *testing.T, remote Remote, repoTag string, contents ...string) ID {
+	id, save := makeSave(t, repoTag, contents...)
+
+	_, err := remote.Push(repoTag, func(repository string, w io.Writer) error {
+		_, err := w.Write(save)
+		return err
+	}, "")
+
+	if err != nil {
+		t.Fatalf("could not push %s: %v", repoTag, err)
+	}
+
+	return id
+}
+
+// newTestRemote returns a filesystem remote in a temporary directory, and a
+// func that removes it
+func newTestRemote(t *testing.T, config Config) (Remote, func()) {
+	root, err := ioutil.TempDir("", "azdockertool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Type = RemoteTypeFilesystem
+	config.Path = root
+	if config.Concurrency == 0 {
+		config.Concurrency = 2
+	}
+
+	remote, err := NewFilesystemRemote(&config)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+
+	return remote, func() { os.RemoveAll(root) }
+}
+
+// readTar reads every file of a tarball
+func readTar(r io.Reader) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		files[hdr.Name] = b
+	}
+}
+
+func TestPushThenPull(t *testing.T) {
+	configs := []Config{
+		{Layout: LayoutLegacy, Compression: CompressionNone},
+		{Layout: LayoutLegacy, Compression: CompressionGzip},
+		{Layout: LayoutCAS, Compression: CompressionZstd},
+	}
+
+	for _, config := range configs {
+		remote, cleanup := newTestRemote(t, config)
+		defer cleanup()
+
+		contents := []string{"base", "middle", "top"}
+		id := pushSave(t, remote, "team/app:v1", contents...)
+
+		var loaded map[string][]byte
+		res, err := remote.Pull("team/app:v1", func(ID) (bool, error) { return false, nil }, func(r io.Reader) (err error) {
+			loaded, err = readTar(r)
+			return err
+		})
+
+		if err != nil {
+			t.Fatalf("%s/%s: could not pull: %v", config.Layout, config.Compression, err)
+		}
+
+		if res.Id != id {
+			t.Errorf("%s/%s: pulled image %s, pushed %s", config.Layout, config.Compression, res.Id, id)
+		}
+
+		m, err := decodeManifest(bytes.NewReader(loaded["manifest.json"]))
+		if err != nil {
+			t.Fatalf("%s/%s: could not read manifest.json: %v", config.Layout, config.Compression, err)
+		}
+
+		// docker load names the image after the digest of its config
+		if got := ID(bytesDigest(loaded[m.Config])).String(); ID(got) != id || m.ImageId() != string(id) {
+			t.Errorf("%s/%s: loaded image %s (config %s), pushed %s", config.Layout, config.Compression, m.ImageId(), got, id)
+		}
+
+		if len(m.RepoTags) != 1 || m.RepoTags[0] != "team/app:v1" {
+			t.Errorf("%s/%s: loaded tags %v", config.Layout, config.Compression, m.RepoTags)
+		}
+
+		digests, err := layerDigests(m, loaded[m.Config])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(m.Layers) != len(contents) {
+			t.Fatalf("%s/%s: loaded %d layers, pushed %d", config.Layout, config.Compression, len(m.Layers), len(contents))
+		}
+
+		for i, name := range m.Layers {
+			layer := loaded[name]
+			if string(layer) != contents[i] {
+				t.Errorf("%s/%s: layer %d holds %q, pushed %q", config.Layout, config.Compression, i, layer, contents[i])
+			}
+
+			if got, want := bytesDigest(layer), digests[m.LayerIds()[i]]; got != want {
+				t.Errorf("%s/%s: layer %d has digest %s, config says %s", config.Layout, config.Compression, i, got, want)
+			}
+		}
+	}
+}
+
+func TestPullWritesPrefetchedLayersInOrder(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{Layout: LayoutLegacy, Compression: CompressionNone, Concurrency: 3})
+	defer cleanup()
+
+	var contents []string
+	for i := 0; i < 8; i++ {
+		contents = append(contents, fmt.Sprintf("layer %d", i))
+	}
+
+	pushSave(t, remote, "team/app:v1", contents...)
+
+	pull := func() ([]string, error) {
+		var order []string
+		_, err := remote.Pull("team/app:v1", func(ID) (bool, error) { return false, nil }, func(r io.Reader) error {
+			tr := tar.NewReader(r)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+
+				if path.Base(hdr.Name) == "layer.tar" {
+					b, err := ioutil.ReadAll(tr)
+					if err != nil {
+						return err
+					}
+
+					order = append(order, string(b))
+				}
+			}
+		})
+
+		return order, err
+	}
+
+	order, err := pull()
+	if err != nil {
+		t.Fatalf("could not pull: %v", err)
+	} else if fmt.Sprint(order) != fmt.Sprint(contents) {
+		t.Fatalf("layers written as %q, pushed %q", order, contents)
+	}
+
+	// a layer that doesn't match its digest fails the pull once it's reached,
+	// though it was downloaded before those ahead of it were written
+	root := remote.(*FilesystemRemote).root
+	tampered := ID(bytesDigest([]byte(fmt.Sprintf("team/app:v1-5-%s", contents[5])))).String()
+	if err := ioutil.WriteFile(filepath.Join(root, "layers", tampered, "layer.tar"), []byte("layer X"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	order, err = pull()
+	if err == nil || !strings.Contains(err.Error(), ErrDigestMismatch.Error()) {
+		t.Fatalf("expected the pull to fail with %v, got %v", ErrDigestMismatch, err)
+	} else if fmt.Sprint(order) != fmt.Sprint(contents[:5]) {
+		t.Errorf("layers written before failing: %q, expected %q", order, contents[:5])
+	}
+}
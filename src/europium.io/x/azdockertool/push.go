@@ -0,0 +1,551 @@
+package azdockertool
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// the files at the top of a save (manifest.json, repositories, the image
+	// config) are held in memory, so anything bigger is refused
+	maxSaveMetadataSize int64 = 16 * 1024 * 1024
+)
+
+// streamedLayer is what Push knows about a layer of the save it is reading
+type streamedLayer struct {
+	status      string            // LayerFound, LayerSent, LayerFailed or LayerSkipped
+	digest      string            // of the layer.tar as sent, before any compression
+	files       int               // of the layer's files the save has had so far
+	blobs       []string          // as sent, for rolling back
+	staged      string            // where layer.tar waits under uploads/ until it's checked
+	json        []byte            // held back until layer.tar is in place, if compressing
+	compression *layerCompression // how layer.tar was sent, if compressed
+	desc        *descriptor       // the blob layer.tar is stored as, if content addressed
+}
+
+// Sends a Docker image to the remote, straight from the `docker save` stream
+// the exporter writes.
+//
+// A save (docker 1.10+) is a tar of a directory per layer ({id}/VERSION,
+// {id}/json, {id}/layer.tar) followed by the image config ({image id}.json),
+// manifest.json and repositories. Docker writes it in lexical order, so what
+// the image is made of is only known once the whole stream has gone by. So,
+// each layer is looked up in the remote as it arrives and, if it's missing,
+// its layer.tar is staged under uploads/ from the stream as it's read
+// (compressed, if the environment says so); the few small files at the top
+// are kept in memory. At the end, the layers staged are checked against the
+// digests in the image config, and only those that match are moved into
+// place, so nothing unchecked ever looks like a layer; then the image is
+// published. If anything goes wrong, layers sent so far are deleted again.
+//
+// Reading the save as a stream means layers are sent one after another, in
+// the order it has them; --concurrency applies to the blocks of each. Once one
+// fails, the rest are reported as skipped. If expect is given, the image's
+// tags are moved only if they name that (partial) image ID now.
+func (l *layout) Push(query string, exporter func(repository string, w io.Writer) error, expect ID) (*PushResult, error) {
+	// fail before exporting anything if we won't be able to upload it
+	if err := l.checkPermissions("push", "rlw"); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(exporter(query, pw))
+	}()
+
+	// stops the export if we give up early
+	defer pr.Close()
+
+	res := &PushResult{}
+	layers := make(map[ID]*streamedLayer)
+	published := false
+
+	defer func() {
+		if !published {
+			l.rollbackLayers(layers)
+		}
+
+		l.discardStaged(layers)
+	}()
+
+	root, order, err := l.receiveSave(tar.NewReader(pr), layers)
+	if err != nil {
+		if m, merr := decodeManifest(bytes.NewReader(root["manifest.json"])); root["manifest.json"] != nil && merr == nil {
+			order = m.LayerIds()
+		}
+
+		res.Layers = layerStatuses(order, layers)
+		return res, err
+	}
+
+	m, err := decodeManifest(bytes.NewReader(root["manifest.json"]))
+	if root["manifest.json"] == nil || err != nil {
+		return nil, fmt.Errorf("could not read the manifest.json of the save: %v", err)
+	}
+
+	if l.config.Verbose {
+		log.WithFields(log.Fields{
+			"repository": query,
+			"image id":   m.ImageId(),
+		}).Info("exported image")
+	}
+
+	// the image config says what each layer.tar should hash to
+	config := root[m.Config]
+	if err := checkDigest(m.Config, imageDigest(ID(m.ImageId())), bytesDigest(config)); err != nil {
+		return nil, err
+	}
+
+	digests, err := layerDigests(m, config)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := m.LayerIds()
+	for _, id := range ids {
+		layer, ok := layers[id]
+		if !ok {
+			res.Layers = layerStatuses(ids, layers)
+			return res, fmt.Errorf("the save is missing layer '%s'", id.Short())
+		}
+
+		if layer.status != LayerSent {
+			continue
+		}
+
+		var err error
+		if (l.cas() && layer.desc == nil) || (!l.cas() && (layer.staged == "" || layer.files != len(layerFiles))) {
+			err = fmt.Errorf("the save has an incomplete layer '%s'", id.Short())
+		} else {
+			err = checkDigest(fmt.Sprintf("layers/%s/layer.tar", id), digests[id], layer.digest)
+		}
+
+		if err != nil {
+			layer.status = LayerFailed
+			res.Layers = layerStatuses(ids, layers)
+			return res, err
+		}
+	}
+
+	res.Layers = layerStatuses(ids, layers)
+
+	// fail now, rather than after publishing, if a tag isn't to be moved
+	refs, err := l.readRefs(ID(m.ImageId()), m.RepoTags, expect)
+	if err != nil {
+		return res, err
+	}
+
+	for _, id := range ids {
+		if layer := layers[id]; layer.status == LayerSent {
+			if err := l.promoteLayer(id, layer); err != nil {
+				return res, fmt.Errorf("could not store layer '%s': %v", id.Short(), err)
+			}
+		}
+	}
+
+	// now upload image metadata
+	if l.cas() {
+		var descs []descriptor
+		for _, id := range ids {
+			descs = append(descs, *layers[id].desc)
+		}
+
+		err = l.putCASImage(ID(m.ImageId()), config, descs)
+	} else {
+		err = l.putImageMetadata(m, root)
+	}
+
+	if err != nil {
+		return res, err
+	}
+
+	published = true
+
+	err = l.putRefs(ID(m.ImageId()), refs, expect)
+	if err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// Reads a save, uploading the files of the layers the remote doesn't have yet
+// as they go by and recording what became of each layer in layers; returns
+// the files at the top of the save, and the layers in the order they came.
+//
+// Once a layer fails, the rest of the save is still read, though nothing more
+// is sent, so that every layer after it can be recorded as skipped; the
+// failure is returned at the end, along with what the save held.
+func (l *layout) receiveSave(tr *tar.Reader, layers map[ID]*streamedLayer) (map[string][]byte, []ID, error) {
+	root := make(map[string][]byte)
+
+	var order []ID
+	var failed error
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil && failed != nil {
+			return root, order, failed
+		} else if err != nil {
+			return nil, order, fmt.Errorf("could not read the save: %v", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		dir, name := path.Split(path.Clean(hdr.Name))
+		if dir == "" {
+			if hdr.Size > maxSaveMetadataSize {
+				return nil, order, fmt.Errorf("'%s' is too large to be part of a save", name)
+			}
+
+			root[name], err = ioutil.ReadAll(tr)
+			if err != nil && failed != nil {
+				return root, order, failed
+			} else if err != nil {
+				return nil, order, fmt.Errorf("could not read the save: %v", err)
+			}
+
+			continue
+		}
+
+		id := ID(strings.TrimSuffix(dir, "/"))
+		layer, ok := layers[id]
+		if !ok {
+			if failed != nil {
+				layer = &streamedLayer{status: LayerSkipped}
+			} else if layer, err = l.discoverLayer(id); err != nil {
+				layer, failed = &streamedLayer{status: LayerFailed}, err
+			}
+
+			layers[id] = layer
+			order = append(order, id)
+		}
+
+		if layer.status != LayerSent || failed != nil {
+			continue // tr.Next skips it
+		}
+
+		if err := l.receiveLayerFile(id, name, layer, tr, hdr.Size); err != nil {
+			layer.status = LayerFailed
+			log.WithFields(log.Fields{
+				"layer id": string(id),
+				"reason":   err.Error(),
+			}).Error("failed to upload missing layer")
+			failed = err
+		}
+	}
+
+	return root, order, failed
+}
+
+// Uploads a file of a missing layer from the save. Its layer.tar is staged
+// under uploads/, compressed on the way with compression, until it's been
+// checked; with compression, the layer's json is held back too, so that it
+// can record how.
+func (l *layout) receiveLayerFile(id ID, name string, layer *streamedLayer, r io.Reader, size int64) error {
+	codec := l.config.Compression
+	if l.cas() {
+		return l.receiveCASLayerFile(id, name, layer, r, codec)
+	}
+
+	layer.files++
+	compressed := codec != "" && codec != CompressionNone
+
+	switch {
+	case name == "layer.tar":
+		layer.staged = stagingName(id)
+		if !compressed {
+			var err error
+			layer.digest, err = l.putBlobFromReader(layer.staged, r, "")
+			return err
+		}
+
+		c, _, err := l.putCompressedBlob(layer.staged, r, codec, "")
+		if err != nil {
+			return err
+		}
+
+		layer.digest = c.Digest
+		layer.compression = c
+
+		if l.config.Verbose {
+			log.WithFields(log.Fields{
+				"layer id": string(id),
+				"codec":    c.Codec,
+				"size":     c.Size,
+			}).Info("compressed layer")
+		}
+
+		return nil
+
+	case name == "json" && compressed:
+		if size > maxSaveMetadataSize {
+			return fmt.Errorf("the json of layer '%s' is too large", id.Short())
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("could not read the save: %v", err)
+		}
+
+		layer.json = b
+		return nil
+	}
+
+	blobName := fmt.Sprintf("layers/%s/%s", id, name)
+	if _, err := l.putBlobFromReader(blobName, r, ""); err != nil {
+		return err
+	}
+
+	layer.blobs = append(layer.blobs, blobName)
+	return nil
+}
+
+// Moves a checked layer into place: in the legacy layout, the json held back
+// and then layer.tar, from where it was staged; content addressed, the link
+// from the layer to its blob
+func (l *layout) promoteLayer(id ID, layer *streamedLayer) error {
+	if l.cas() {
+		link, err := l.putLink(id, layer.desc)
+		if err != nil {
+			return err
+		}
+
+		layer.blobs = append(layer.blobs, link)
+		return nil
+	}
+
+	if layer.json != nil {
+		b, err := withLayerCompression(layer.json, layer.compression)
+		if err != nil {
+			return err
+		}
+
+		blobName := fmt.Sprintf("layers/%s/json", id)
+		if _, err := l.putBlobFromReader(blobName, bytes.NewReader(b), ""); err != nil {
+			return err
+		}
+
+		layer.blobs = append(layer.blobs, blobName)
+	}
+
+	// rolled back even if it only got part way
+	blobName := fmt.Sprintf("layers/%s/layer.tar", id)
+	layer.blobs = append(layer.blobs, blobName)
+
+	return l.duplicateBlob(layer.staged, blobName)
+}
+
+// Decides whether a layer of the save needs uploading
+func (l *layout) discoverLayer(id ID) (*streamedLayer, error) {
+	var ok bool
+	var desc *descriptor
+	var err error
+
+	if l.cas() {
+		desc, err = l.findLink(id)
+		ok = desc != nil
+	} else {
+		ok, err = l.HasLayer(id)
+	}
+
+	if err != nil && err != ErrIncompleteLayer {
+		return nil, err
+	}
+
+	if ok {
+		if l.config.Verbose {
+			log.WithFields(log.Fields{
+				"layer id": string(id),
+			}).Info("found layer")
+		}
+
+		return &streamedLayer{status: LayerFound, desc: desc}, nil
+	}
+
+	log.WithFields(log.Fields{
+		"layer id": string(id),
+	}).Info("uploading layer")
+
+	return &streamedLayer{status: LayerSent}, nil
+}
+
+// Uploads the layer.tar of a missing layer as a content addressed blob, to
+// be linked to the layer once it's been checked; nothing else of a layer is
+// kept in this layout
+func (l *layout) receiveCASLayerFile(id ID, name string, layer *streamedLayer, r io.Reader, codec string) error {
+	if name != "layer.tar" {
+		return nil
+	}
+
+	desc, diffID, created, err := l.putLayerBlob(id, r, codec)
+	if err != nil {
+		return err
+	}
+
+	if created {
+		layer.blobs = append(layer.blobs, blobPath(desc.Digest))
+	}
+
+	// linked once it's been checked; see promoteLayer
+	layer.digest = diffID
+	layer.desc = desc
+
+	if l.config.Verbose {
+		log.WithFields(log.Fields{
+			"layer id": string(id),
+			"digest":   desc.Digest,
+			"new":      created,
+		}).Info("stored layer")
+	}
+
+	return nil
+}
+
+// Deletes the blobs of every layer sent by a push that didn't complete
+func (l *layout) rollbackLayers(layers map[ID]*streamedLayer) {
+	for id, layer := range layers {
+		for i := len(layer.blobs) - 1; i >= 0; i-- {
+			if err := l.store.deleteBlob(layer.blobs[i]); err != nil {
+				log.WithFields(log.Fields{
+					"path":   layer.blobs[i],
+					"reason": err.Error(),
+				}).Error("failed to roll back blob")
+			}
+		}
+
+		if len(layer.blobs) > 0 {
+			log.WithFields(log.Fields{
+				"layer id": string(id),
+			}).Warn("rolled back layer")
+		}
+	}
+}
+
+// Deletes whatever a push staged under uploads/, once it's done with it
+func (l *layout) discardStaged(layers map[ID]*streamedLayer) {
+	for _, layer := range layers {
+		if layer.staged == "" {
+			continue
+		}
+
+		if err := l.store.deleteBlob(layer.staged); err != nil {
+			log.WithFields(log.Fields{
+				"path":   layer.staged,
+				"reason": err.Error(),
+			}).Warn("failed to delete staged upload")
+		}
+	}
+}
+
+// Lists what became of each of the given layers, in order
+func layerStatuses(ids []ID, layers map[ID]*streamedLayer) []LayerStatus {
+	var coll []LayerStatus
+	for _, id := range ids {
+		if layer, ok := layers[id]; ok {
+			coll = append(coll, LayerStatus{Id: id, Status: layer.status})
+		}
+	}
+
+	return coll
+}
+
+func (l *layout) putImageMetadata(m *manifest, root map[string][]byte) error {
+	const (
+		ImagesFormat = "images/%s/%s"
+	)
+
+	id := m.ImageId()
+
+	// manifest.json goes last; it's what makes the image visible
+	parts := []struct{ src, dst string }{
+		{m.Config, "json"},
+		{"repositories", "repositories"},
+		{"manifest.json", "manifest.json"},
+	}
+
+	for _, part := range parts {
+		_, err := l.putBlobFromReader(fmt.Sprintf(ImagesFormat, id, part.dst), bytes.NewReader(root[part.src]), "")
+		if err != nil {
+			log.WithFields(log.Fields{
+				"image id": string(id),
+				"rollback": false,
+			}).Error("failed to upload image metadata")
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"image id": m.ImageId(),
+	}).Info("published image")
+
+	return nil
+}
+
+// Sends a stream to the remote, hashing it on the way, and returns its
+// digest. Given the digest to expect, a stream that doesn't match it is never
+// committed; either way the digest is kept with the blob where the store allows.
+func (l *layout) putBlobFromReader(name string, r io.Reader, digest string) (string, error) {
+	d := newDigestingReader(name, r, digest)
+	if err := l.store.putBlob(name, d); err != nil {
+		return "", err
+	}
+
+	if ms, ok := l.store.(metadataStore); ok {
+		if err := ms.setBlobMetadata(name, map[string]string{digestMetadataKey: d.Digest()}); err != nil {
+			return "", err
+		}
+	}
+
+	return d.Digest(), nil
+}
+
+type manifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+
+	cas *casManifest // what was read, if the image is content addressed
+}
+
+// decodes a Docker 1.10+ manifest.json describing exactly one image
+func decodeManifest(r io.Reader) (*manifest, error) {
+	var arr []manifest
+	err := json.NewDecoder(r).Decode(&arr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(arr) != 1 {
+		return nil, errors.New("idk wtf")
+	}
+
+	return &arr[0], nil
+}
+
+func (m *manifest) ImageId() string {
+	return strings.TrimSuffix(m.Config, filepath.Ext(m.Config))
+}
+
+func (m *manifest) LayerIds() []ID {
+	var pile []ID
+
+	for _, v := range m.Layers {
+		dir, _ := filepath.Split(v)
+		pile = append(pile, ID(filepath.Clean(dir)))
+	}
+
+	return pile
+}
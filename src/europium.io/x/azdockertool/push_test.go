@@ -0,0 +1,108 @@
+package azdockertool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPushRefusesLayersThatDontMatch(t *testing.T) {
+	for _, config := range []Config{{Layout: LayoutLegacy, Compression: CompressionGzip}, {Layout: LayoutCAS}} {
+		remote, cleanup := newTestRemote(t, config)
+		defer cleanup()
+
+		_, save := makeTamperedSave(t, "team/app:v1", func(files map[string][]byte) {
+			for name := range files {
+				if strings.HasSuffix(name, "/layer.tar") && string(files[name]) == "top" {
+					files[name] = []byte("not top")
+				}
+			}
+		}, "base", "top")
+
+		_, err := remote.Push("team/app:v1", func(repository string, w io.Writer) error {
+			_, err := w.Write(save)
+			return err
+		}, "")
+
+		if err != ErrDigestMismatch {
+			t.Fatalf("%s: expected ErrDigestMismatch, got %v", config.Layout, err)
+		}
+
+		// nothing unchecked may be left looking like a layer, or staged
+		blobs, err := remote.(*FilesystemRemote).listBlobs("")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, item := range blobs {
+			t.Errorf("%s: push left '%s' behind", config.Layout, item.Name)
+		}
+	}
+}
+
+// failingStore is a filesystem remote that fails to write one blob
+type failingStore struct {
+	*FilesystemRemote
+	name string
+}
+
+func (s *failingStore) putBlob(name string, r io.Reader) error {
+	if name == s.name {
+		return errors.New("injected failure")
+	}
+
+	return s.FilesystemRemote.putBlob(name, r)
+}
+
+func TestPushSkipsLayersAfterOneFails(t *testing.T) {
+	for _, config := range []Config{{Layout: LayoutLegacy}, {Layout: LayoutCAS}} {
+		remote, cleanup := newTestRemote(t, config)
+		defer cleanup()
+
+		pushSave(t, remote, "team/app:v1", "a")
+
+		contents := []string{"a", "b", "c", "d", "e"}
+		_, save := makeSave(t, "team/app:v1", contents...)
+
+		var ids []ID
+		for i, c := range contents {
+			ids = append(ids, ID(ID(bytesDigest([]byte(fmt.Sprintf("team/app:v1-%d-%s", i, c)))).String()))
+		}
+
+		fr := remote.(*FilesystemRemote)
+		fr.layout = &layout{fr.config, &failingStore{fr, stagingName(ids[2])}}
+
+		res, err := remote.Push("team/app:v1", func(repository string, w io.Writer) error {
+			_, err := w.Write(save)
+			return err
+		}, "")
+
+		if err == nil {
+			t.Fatalf("%s: push succeeded", config.Layout)
+		}
+
+		// the save has layers in lexical order; those after the one that
+		// failed aren't sent
+		var want []LayerStatus
+		for i, id := range ids {
+			status := LayerSkipped
+			switch {
+			case i == 0:
+				status = LayerFound
+			case i == 2:
+				status = LayerFailed
+			case id < ids[2]:
+				status = LayerSent
+			}
+
+			want = append(want, LayerStatus{Id: id, Status: status})
+		}
+
+		if res == nil || !reflect.DeepEqual(res.Layers, want) {
+			t.Errorf("%s: push reported %v, expected %v", config.Layout, res, want)
+		}
+	}
+}
@@ -0,0 +1,824 @@
+package azdockertool
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RegistryImage is an image as the registry API serves it: a schema 2
+// manifest, and where each blob it names is in the remote
+type RegistryImage struct {
+	Id        ID
+	MediaType string
+	Manifest  []byte
+	Digest    string // of Manifest
+
+	blobs  map[string]blobInfo // by digest
+	layout *layout
+}
+
+// Makes a schema 2 manifest of an image, given a tag or (partial) image ID.
+// Content addressed images already have one; legacy ones are translated,
+// naming a compressed layer by the digest of what's stored rather than what
+// docker saved.
+func (l *layout) RegistryImage(query string) (*RegistryImage, error) {
+	id, _, _, err := l.resolveImage(query)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := l.getManifest(fmt.Sprintf("images/%s/manifest.json", id))
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest of image '%s': %v", id.Short(), err)
+	}
+
+	img := &RegistryImage{Id: id, MediaType: MediaTypeManifest, blobs: make(map[string]blobInfo), layout: l}
+
+	cm := m.cas
+	if cm == nil {
+		cm, err = l.registryManifest(id, m, img.blobs)
+	} else {
+		err = l.registryBlobs(cm, img.blobs)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if img.Manifest, err = json.Marshal(cm); err != nil {
+		return nil, err
+	}
+
+	img.Digest = bytesDigest(img.Manifest)
+	return img, nil
+}
+
+// Translates the manifest of a legacy image, finding its blobs as it goes
+func (l *layout) registryManifest(id ID, m *manifest, blobs map[string]blobInfo) (*casManifest, error) {
+	item, err := l.statBlob(m.configBlob())
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := l.getVerified(item)
+	if err != nil {
+		return nil, err
+	} else if err := checkDigest(item.Name, imageDigest(id), bytesDigest(config)); err != nil {
+		return nil, err
+	}
+
+	digests, err := layerDigests(m, config)
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &casManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        descriptor{MediaType: MediaTypeConfig, Size: item.Size, Digest: imageDigest(id)},
+	}
+
+	blobs[cm.Config.Digest] = item
+
+	for i, lid := range m.LayerIds() {
+		item, err := l.statBlob(m.layerBlob(i))
+		if err != nil {
+			return nil, fmt.Errorf("layer '%s': %v", lid.Short(), err)
+		}
+
+		c, err := l.getLayerCompression(lid)
+		if err != nil {
+			return nil, fmt.Errorf("layer '%s': %v", lid.Short(), err)
+		}
+
+		desc := descriptor{MediaType: MediaTypeLayer, Size: item.Size, Digest: digests[lid]}
+		if c != nil {
+			desc.MediaType = layerMediaType(c.Codec)
+			if desc.Digest, err = l.storedDigest(item.Name); err != nil {
+				return nil, err
+			}
+		}
+
+		blobs[desc.Digest] = item
+		cm.Layers = append(cm.Layers, desc)
+	}
+
+	return cm, nil
+}
+
+// Finds the blobs a content addressed manifest names
+func (l *layout) registryBlobs(cm *casManifest, blobs map[string]blobInfo) error {
+	for _, desc := range append([]descriptor{cm.Config}, cm.Layers...) {
+		item, err := l.statBlob(blobPath(desc.Digest))
+		if err != nil {
+			return fmt.Errorf("'%s': %v", desc.Digest, err)
+		}
+
+		blobs[desc.Digest] = item
+	}
+
+	return nil
+}
+
+// Opens a blob the manifest names, checking it against its digest as it's
+// read, and returns its size; ErrBlobNotFound if the manifest names no such
+// blob
+func (img *RegistryImage) OpenBlob(digest string) (io.ReadCloser, int64, error) {
+	item, ok := img.blobs[digest]
+	if !ok {
+		return nil, 0, ErrBlobNotFound
+	}
+
+	f, err := img.layout.openVerified(item, digest)
+	return f, item.Size, err
+}
+
+// registry serves the Docker Registry HTTP API (v2)
+type registry struct {
+	remote Remote
+
+	mu     sync.Mutex
+	images map[ID]*RegistryImage // images never change, so they're kept
+}
+
+// Returns a handler serving the Docker Registry HTTP API (v2) from a remote,
+// so that `docker pull` and `docker push` can be pointed straight at it.
+// Repositories and tags are those of refs/, held to the distribution spec's
+// grammar; manifests are made into schema 2 ones as they're asked for. Blobs
+// pushed are kept aside until the manifest naming them arrives, and then the
+// image is pushed into the remote as a save, just as the push command would,
+// so images pushed either way are the same. There's no authentication, so
+// it's for serving to localhost, or behind a proxy.
+func NewRegistryHandler(remote Remote) http.Handler {
+	return &registry{remote: remote, images: make(map[ID]*RegistryImage)}
+}
+
+func (reg *registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	log.WithFields(log.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	}).Info("registry request")
+
+	reading := r.Method == "GET" || r.Method == "HEAD"
+
+	p := r.URL.Path
+	if (p == "/v2" || p == "/v2/") && reading {
+		reg.writeJSON(w, r, struct{}{})
+		return
+	} else if p == "/v2/_catalog" && reading {
+		reg.serveCatalog(w, r)
+		return
+	}
+
+	name, kind, ref, ok := parseRegistryPath(p)
+	if !ok {
+		reg.fail(w, http.StatusNotFound, "NAME_UNKNOWN", "no such endpoint")
+		return
+	} else if !registryName.MatchString(name) || len(name) > 255 {
+		reg.fail(w, http.StatusBadRequest, "NAME_INVALID", fmt.Sprintf("invalid repository name '%s'", name))
+		return
+	} else if kind == "manifests" && !strings.HasPrefix(ref, "sha256:") && !registryTag.MatchString(ref) {
+		reg.fail(w, http.StatusBadRequest, "TAG_INVALID", fmt.Sprintf("invalid tag '%s'", ref))
+		return
+	}
+
+	switch {
+	case kind == "tags" && reading:
+		reg.serveTags(w, r, name)
+	case kind == "manifests" && reading:
+		reg.serveManifest(w, r, name, ref)
+	case kind == "manifests" && r.Method == "PUT":
+		reg.putManifest(w, r, name, ref)
+	case kind == "blobs" && reading:
+		reg.serveBlob(w, r, name, ref)
+	case kind == "uploads" && ref == "" && r.Method == "POST":
+		reg.startUpload(w, r, name)
+	case kind == "uploads" && ref != "" && reading:
+		reg.serveUpload(w, r, name, ref)
+	case kind == "uploads" && ref != "" && r.Method == "PATCH":
+		reg.patchUpload(w, r, name, ref)
+	case kind == "uploads" && ref != "" && r.Method == "PUT":
+		reg.finishUpload(w, r, name, ref)
+	case kind == "uploads" && ref != "" && r.Method == "DELETE":
+		reg.cancelUpload(w, r, name, ref)
+	default:
+		reg.fail(w, http.StatusMethodNotAllowed, "UNSUPPORTED", fmt.Sprintf("%s is not supported here", r.Method))
+	}
+}
+
+// What the distribution spec allows of repository names and tags; names are
+// made into paths in the remote, so nothing else is let through
+var (
+	registryName = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	registryTag  = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// Splits /v2/{name}/(manifests/{ref}|blobs/{digest}|blobs/uploads/[{uuid}]|
+// tags/list) into its parts; names may have slashes in them
+func parseRegistryPath(p string) (name, kind, ref string, ok bool) {
+	if !strings.HasPrefix(p, "/v2/") {
+		return "", "", "", false
+	}
+
+	p = strings.TrimPrefix(p, "/v2/")
+	if strings.HasSuffix(p, "/tags/list") {
+		name = strings.TrimSuffix(p, "/tags/list")
+		return name, "tags", "", name != ""
+	}
+
+	if i := strings.LastIndex(p, "/blobs/uploads/"); i > 0 {
+		ref = p[i+len("/blobs/uploads/"):]
+		return p[:i], "uploads", ref, !strings.Contains(ref, "/")
+	}
+
+	for _, kind := range []string{"manifests", "blobs"} {
+		i := strings.LastIndex(p, "/"+kind+"/")
+		if i <= 0 {
+			continue
+		}
+
+		ref = p[i+len(kind)+2:]
+		if ref == "" || strings.Contains(ref, "/") {
+			return "", "", "", false
+		}
+
+		return p[:i], kind, ref, true
+	}
+
+	return "", "", "", false
+}
+
+func (reg *registry) serveCatalog(w http.ResponseWriter, r *http.Request) {
+	refs, err := reg.remote.Images()
+	if err != nil {
+		reg.failed(w, err, "NAME_UNKNOWN")
+		return
+	}
+
+	var names []string
+	for _, ref := range refs {
+		if len(names) == 0 || names[len(names)-1] != ref.Repository {
+			names = append(names, ref.Repository)
+		}
+	}
+
+	names = reg.paginate(w, r, names)
+	reg.writeJSON(w, r, map[string][]string{"repositories": names})
+}
+
+func (reg *registry) serveTags(w http.ResponseWriter, r *http.Request, name string) {
+	refs, err := reg.tags(name)
+	if err != nil {
+		reg.failed(w, err, "NAME_UNKNOWN")
+		return
+	} else if len(refs) == 0 {
+		reg.fail(w, http.StatusNotFound, "NAME_UNKNOWN", fmt.Sprintf("no such repository '%s'", name))
+		return
+	}
+
+	var tags []string
+	for _, ref := range refs {
+		tags = append(tags, ref.Tag)
+	}
+
+	tags = reg.paginate(w, r, tags)
+	reg.writeJSON(w, r, map[string]interface{}{"name": name, "tags": tags})
+}
+
+// Serves the manifest of a repository's image, by tag or by the manifest's
+// own digest
+func (reg *registry) serveManifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	refs, err := reg.tags(name)
+	if err != nil {
+		reg.failed(w, err, "MANIFEST_UNKNOWN")
+		return
+	}
+
+	byDigest := strings.HasPrefix(ref, "sha256:")
+
+	var img *RegistryImage
+	for _, info := range refs {
+		if !byDigest && info.Tag != ref {
+			continue
+		}
+
+		candidate, err := reg.image(info.Id)
+		if err != nil {
+			reg.failed(w, err, "MANIFEST_UNKNOWN")
+			return
+		}
+
+		if !byDigest || candidate.Digest == ref {
+			img = candidate
+			break
+		}
+	}
+
+	if img == nil {
+		reg.fail(w, http.StatusNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("no manifest '%s' in '%s'", ref, name))
+		return
+	}
+
+	w.Header().Set("Content-Type", img.MediaType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(img.Manifest)))
+	w.Header().Set("Docker-Content-Digest", img.Digest)
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, img.Digest))
+
+	if r.Method != "HEAD" {
+		w.Write(img.Manifest)
+	}
+}
+
+// Serves a blob named by one of a repository's images, or pushed to it
+func (reg *registry) serveBlob(w http.ResponseWriter, r *http.Request, name, digest string) {
+	blob, err := reg.findBlob(name, digest)
+	if err == ErrBlobNotFound || err == ErrUnsupportedDigest {
+		reg.fail(w, http.StatusNotFound, "BLOB_UNKNOWN", fmt.Sprintf("no blob '%s' in '%s'", digest, name))
+		return
+	} else if err != nil {
+		reg.failed(w, err, "BLOB_UNKNOWN")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(blob.size, 10))
+	w.Header().Set("Docker-Content-Digest", digest)
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	f, err := blob.open()
+	if err != nil {
+		reg.forget(blob.image)
+		reg.failed(w, err, "BLOB_UNKNOWN")
+		return
+	}
+
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		// too late to say so in the response
+		reg.forget(blob.image)
+		log.WithFields(log.Fields{
+			"path":   r.URL.Path,
+			"reason": err.Error(),
+		}).Error("failed to send blob")
+	}
+}
+
+// registryBlob is a blob the registry can serve
+type registryBlob struct {
+	size  int64
+	open  func() (io.ReadCloser, error)
+	image ID // that names it, unless it was pushed but isn't in an image yet
+}
+
+// Finds a blob for a repository: one pushed, but not yet part of an image, or
+// one of the repository's images names. Returns ErrBlobNotFound if there's
+// none.
+func (reg *registry) findBlob(name, digest string) (*registryBlob, error) {
+	uploads := reg.remote.RegistryUploads()
+
+	size, err := uploads.Stat(digest)
+	if err == nil {
+		return &registryBlob{size: size, open: func() (io.ReadCloser, error) { return uploads.Open(digest) }}, nil
+	} else if err != ErrBlobNotFound {
+		return nil, err
+	}
+
+	refs, err := reg.tags(name)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[ID]bool)
+	for _, info := range refs {
+		if seen[info.Id] {
+			continue
+		}
+
+		seen[info.Id] = true
+
+		img, err := reg.image(info.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		if item, ok := img.blobs[digest]; ok {
+			open := func() (io.ReadCloser, error) {
+				f, _, err := img.OpenBlob(digest)
+				return f, err
+			}
+
+			return &registryBlob{size: item.Size, open: open, image: info.Id}, nil
+		}
+	}
+
+	return nil, ErrBlobNotFound
+}
+
+// Starts an upload session; or, given ?digest=, takes the whole blob at once;
+// or, given ?mount= a blob that's already here, skips uploading it
+func (reg *registry) startUpload(w http.ResponseWriter, r *http.Request, name string) {
+	uploads := reg.remote.RegistryUploads()
+	q := r.URL.Query()
+
+	if digest := q.Get("digest"); digest != "" {
+		if err := uploads.Put(digest, r.Body); err != nil {
+			reg.uploadFailed(w, err)
+			return
+		}
+
+		reg.created(w, name, digest)
+		return
+	}
+
+	if digest := q.Get("mount"); digest != "" {
+		from := q.Get("from")
+		if from == "" {
+			from = name
+		}
+
+		if _, err := reg.findBlob(from, digest); err == nil {
+			reg.created(w, name, digest)
+			return
+		}
+	}
+
+	uuid, err := uploads.Start()
+	if err != nil {
+		reg.failed(w, err, "BLOB_UPLOAD_UNKNOWN")
+		return
+	}
+
+	reg.accepted(w, name, uuid, 0)
+}
+
+// Reports how much of an upload session has arrived
+func (reg *registry) serveUpload(w http.ResponseWriter, r *http.Request, name, uuid string) {
+	size, err := reg.remote.RegistryUploads().Size(uuid)
+	if err != nil {
+		reg.uploadFailed(w, err)
+		return
+	}
+
+	reg.uploadStatus(w, name, uuid, size)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Appends a chunk to an upload session; one sent with Content-Range has to
+// carry on from where the last left off
+func (reg *registry) patchUpload(w http.ResponseWriter, r *http.Request, name, uuid string) {
+	uploads := reg.remote.RegistryUploads()
+
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		size, err := uploads.Size(uuid)
+		if err != nil {
+			reg.uploadFailed(w, err)
+			return
+		}
+
+		if start, ok := parseContentRange(cr); !ok || start != size {
+			reg.uploadStatus(w, name, uuid, size)
+			reg.fail(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", fmt.Sprintf("expected a chunk starting at %d", size))
+			return
+		}
+	}
+
+	size, err := uploads.Append(uuid, r.Body)
+	if err != nil {
+		reg.uploadFailed(w, err)
+		return
+	}
+
+	reg.accepted(w, name, uuid, size)
+}
+
+// Ends an upload session, given the digest of what was sent, along with
+// whatever remains of it
+func (reg *registry) finishUpload(w http.ResponseWriter, r *http.Request, name, uuid string) {
+	uploads := reg.remote.RegistryUploads()
+
+	digest := r.URL.Query().Get("digest")
+	if _, err := uploadedBlobPath(digest); err != nil {
+		reg.fail(w, http.StatusBadRequest, "DIGEST_INVALID", fmt.Sprintf("unsupported digest '%s'", digest))
+		return
+	}
+
+	if r.ContentLength != 0 {
+		if _, err := uploads.Append(uuid, r.Body); err != nil {
+			reg.uploadFailed(w, err)
+			return
+		}
+	}
+
+	if err := uploads.Finish(uuid, digest); err != nil {
+		reg.uploadFailed(w, err)
+		return
+	}
+
+	reg.created(w, name, digest)
+}
+
+func (reg *registry) cancelUpload(w http.ResponseWriter, r *http.Request, name, uuid string) {
+	if err := reg.remote.RegistryUploads().Cancel(uuid); err != nil {
+		reg.uploadFailed(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Replies that an upload session has more to come
+func (reg *registry) accepted(w http.ResponseWriter, name, uuid string, size int64) {
+	reg.uploadStatus(w, name, uuid, size)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Sets the headers saying where an upload session is, and how much of it
+// has arrived
+func (reg *registry) uploadStatus(w http.ResponseWriter, name, uuid string, size int64) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, uuid))
+	w.Header().Set("Docker-Upload-UUID", uuid)
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+}
+
+// Replies that a blob has been uploaded
+func (reg *registry) created(w http.ResponseWriter, name, digest string) {
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Replies with what went wrong with an upload
+func (reg *registry) uploadFailed(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNoSuchUpload:
+		reg.fail(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", err.Error())
+	case ErrDigestMismatch, ErrUnsupportedDigest:
+		reg.fail(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+	default:
+		reg.failed(w, err, "BLOB_UPLOAD_UNKNOWN")
+	}
+}
+
+// Returns where a Content-Range of "{start}-{end}" starts
+func parseContentRange(cr string) (int64, bool) {
+	cr = strings.TrimPrefix(strings.TrimPrefix(cr, "bytes "), "bytes=")
+
+	i := strings.Index(cr, "-")
+	if i < 0 {
+		return 0, false
+	}
+
+	start, err := strconv.ParseInt(cr[:i], 10, 64)
+	return start, err == nil
+}
+
+// Takes a schema 2 manifest for a tag, and pushes the image it describes into
+// the remote, from the blobs pushed before it (or already in the
+// repository's images). What's stored is what the push command would store
+// (its layers compressed as the environment says), so the manifest then
+// served for the tag, and its digest, are the remote's own.
+func (reg *registry) putManifest(w http.ResponseWriter, r *http.Request, name, tag string) {
+	if strings.HasPrefix(tag, "sha256:") {
+		reg.fail(w, http.StatusBadRequest, "TAG_INVALID", "manifests can only be pushed by tag")
+		return
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSaveMetadataSize+1))
+	if err != nil {
+		reg.failed(w, err, "")
+		return
+	} else if int64(len(b)) > maxSaveMetadataSize {
+		reg.fail(w, http.StatusRequestEntityTooLarge, "MANIFEST_INVALID", "manifest is too big")
+		return
+	}
+
+	var m casManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		reg.fail(w, http.StatusBadRequest, "MANIFEST_INVALID", fmt.Sprintf("could not read manifest: %v", err))
+		return
+	} else if m.SchemaVersion != 2 || (m.MediaType != "" && m.MediaType != MediaTypeManifest && m.MediaType != MediaTypeOCIManifest) {
+		reg.fail(w, http.StatusBadRequest, "MANIFEST_INVALID", fmt.Sprintf("unsupported manifest '%s' (schema version %d)", m.MediaType, m.SchemaVersion))
+		return
+	}
+
+	for _, layer := range m.Layers {
+		if _, err := layerCodec(layer.MediaType); err != nil {
+			reg.fail(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+	}
+
+	blobs := make(map[string]*registryBlob)
+	for _, desc := range append([]descriptor{m.Config}, m.Layers...) {
+		blob, err := reg.findBlob(name, desc.Digest)
+		if err == ErrBlobNotFound || err == ErrUnsupportedDigest {
+			reg.fail(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", fmt.Sprintf("no blob '%s' in '%s'", desc.Digest, name))
+			return
+		} else if err != nil {
+			reg.failed(w, err, "MANIFEST_BLOB_UNKNOWN")
+			return
+		}
+
+		// the size of an uncompressed layer is taken as its layer.tar's
+		if blob.size != desc.Size {
+			reg.fail(w, http.StatusBadRequest, "MANIFEST_INVALID", fmt.Sprintf("blob '%s' is %d bytes, not %d", desc.Digest, blob.size, desc.Size))
+			return
+		}
+
+		blobs[desc.Digest] = blob
+	}
+
+	config, err := readRegistryBlob(blobs[m.Config.Digest])
+	if err != nil {
+		reg.failed(w, err, "MANIFEST_BLOB_UNKNOWN")
+		return
+	}
+
+	query := fmt.Sprintf("%s:%s", name, tag)
+	_, err = reg.remote.Push(query, func(repository string, w io.Writer) error {
+		repo, tag := toRepositoryAndTag(repository)
+		return writeManifestSave(w, repo, tag, &m, config, func(layer descriptor) (io.ReadCloser, error) {
+			codec, err := layerCodec(layer.MediaType)
+			if err != nil {
+				return nil, err
+			}
+
+			f, err := blobs[layer.Digest].open()
+			if err != nil || codec == "" {
+				return f, err
+			}
+
+			return decompressor(layer.Digest, codec, f)
+		})
+	}, "")
+
+	if conflict, ok := err.(*TagConflictError); ok {
+		reg.fail(w, http.StatusConflict, "DENIED", conflict.Error())
+		return
+	} else if err != nil {
+		reg.failed(w, fmt.Errorf("could not push '%s': %v", query, err), "MANIFEST_BLOB_UNKNOWN")
+		return
+	}
+
+	img, err := reg.remote.RegistryImage(query)
+	if err != nil {
+		reg.failed(w, err, "MANIFEST_UNKNOWN")
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, img.Digest))
+	w.Header().Set("Docker-Content-Digest", img.Digest)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Reads a whole blob, checking it against its digest
+func readRegistryBlob(blob *registryBlob) ([]byte, error) {
+	f, err := blob.open()
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// Returns the tags of a repository
+func (reg *registry) tags(name string) ([]*ImageInfo, error) {
+	refs, err := reg.remote.Images()
+	if err != nil {
+		return nil, err
+	}
+
+	var coll []*ImageInfo
+	for _, ref := range refs {
+		if ref.Repository == name {
+			coll = append(coll, ref)
+		}
+	}
+
+	return coll, nil
+}
+
+// Returns an image as the registry serves it, making it if needs be
+func (reg *registry) image(id ID) (*RegistryImage, error) {
+	reg.mu.Lock()
+	img, ok := reg.images[id]
+	reg.mu.Unlock()
+
+	if ok {
+		return img, nil
+	}
+
+	img, err := reg.remote.RegistryImage(id.String())
+	if err != nil {
+		return nil, err
+	}
+
+	reg.mu.Lock()
+	reg.images[id] = img
+	reg.mu.Unlock()
+
+	return img, nil
+}
+
+// Drops a kept image, in case its blobs moved (say, by migrate)
+func (reg *registry) forget(id ID) {
+	reg.mu.Lock()
+	delete(reg.images, id)
+	reg.mu.Unlock()
+}
+
+// Returns the page of sorted names that ?n= and ?last= ask for, linking to
+// the next one if there is one
+func (reg *registry) paginate(w http.ResponseWriter, r *http.Request, names []string) []string {
+	sort.Strings(names)
+
+	q := r.URL.Query()
+	if last := q.Get("last"); last != "" {
+		i := sort.SearchStrings(names, last)
+		if i < len(names) && names[i] == last {
+			i++
+		}
+
+		names = names[i:]
+	}
+
+	n, err := strconv.Atoi(q.Get("n"))
+	if err != nil || n <= 0 || n >= len(names) {
+		return names
+	}
+
+	names = names[:n]
+
+	next := url.Values{"n": {strconv.Itoa(n)}, "last": {names[n-1]}}
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+
+	return names
+}
+
+func (reg *registry) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		reg.failed(w, err, "")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+
+	if r.Method != "HEAD" {
+		w.Write(b)
+	}
+}
+
+// Replies with a registry error
+func (reg *registry) fail(w http.ResponseWriter, status int, code, message string) {
+	b, _ := json.Marshal(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// Replies with what went wrong with the remote; if it's that something isn't
+// there, with the route's own code for that (none for routes where nothing
+// can be missing)
+func (reg *registry) failed(w http.ResponseWriter, err error, notFound string) {
+	log.WithFields(log.Fields{
+		"reason": err.Error(),
+	}).Error("registry request failed")
+
+	if notFound != "" && (err == ErrNoSuchImage || isNotFound(err)) {
+		reg.fail(w, http.StatusNotFound, notFound, err.Error())
+		return
+	}
+
+	reg.fail(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+}
@@ -0,0 +1,460 @@
+package azdockertool
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// getRegistry sends a request to a registry, returning the response and its
+// body
+func getRegistry(t *testing.T, srv *httptest.Server, method, path string) (*http.Response, []byte) {
+	return sendRegistry(t, srv, method, path, nil, nil)
+}
+
+// sendRegistry is getRegistry, sending a body and headers along
+func sendRegistry(t *testing.T, srv *httptest.Server, method, path string, headers map[string]string, body []byte) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+
+	return res, b
+}
+
+// registryErrorCode returns the code of the first error in a registry error
+// response
+func registryErrorCode(b []byte) string {
+	var body struct {
+		Errors []struct{ Code string }
+	}
+
+	if json.Unmarshal(b, &body) != nil || len(body.Errors) == 0 {
+		return ""
+	}
+
+	return body.Errors[0].Code
+}
+
+func TestRegistryServesPushedImages(t *testing.T) {
+	for _, config := range []Config{{Layout: LayoutLegacy, Compression: CompressionGzip}, {Layout: LayoutCAS, Compression: CompressionZstd}} {
+		remote, cleanup := newTestRemote(t, config)
+		defer cleanup()
+
+		id := pushSave(t, remote, "team/app:v1", "base", "top")
+		pushSave(t, remote, "team/app:v2", "base", "other")
+		pushSave(t, remote, "team/db:v1", "db")
+
+		srv := httptest.NewServer(NewRegistryHandler(remote))
+		defer srv.Close()
+
+		res, _ := getRegistry(t, srv, "GET", "/v2/")
+		if res.StatusCode != http.StatusOK || res.Header.Get("Docker-Distribution-API-Version") != "registry/2.0" {
+			t.Errorf("%s: /v2/ replied %d, version %q", config.Layout, res.StatusCode, res.Header.Get("Docker-Distribution-API-Version"))
+		}
+
+		var catalog struct{ Repositories []string }
+		res, b := getRegistry(t, srv, "GET", "/v2/_catalog")
+		if err := json.Unmarshal(b, &catalog); err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: _catalog replied %d: %s", config.Layout, res.StatusCode, b)
+		} else if want := []string{"team/app", "team/db"}; !reflect.DeepEqual(catalog.Repositories, want) {
+			t.Errorf("%s: _catalog listed %v, expected %v", config.Layout, catalog.Repositories, want)
+		}
+
+		var tags struct {
+			Name string
+			Tags []string
+		}
+
+		res, b = getRegistry(t, srv, "GET", "/v2/team/app/tags/list")
+		if err := json.Unmarshal(b, &tags); err != nil || res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: tags/list replied %d: %s", config.Layout, res.StatusCode, b)
+		} else if want := []string{"v1", "v2"}; tags.Name != "team/app" || !reflect.DeepEqual(tags.Tags, want) {
+			t.Errorf("%s: tags/list listed %s %v, expected team/app %v", config.Layout, tags.Name, tags.Tags, want)
+		}
+
+		// the manifest, by tag and then by its own digest
+		res, manifest := getRegistry(t, srv, "GET", "/v2/team/app/manifests/v1")
+		digest := res.Header.Get("Docker-Content-Digest")
+		if res.StatusCode != http.StatusOK || digest != bytesDigest(manifest) {
+			t.Fatalf("%s: manifest by tag replied %d, digest %s for %s", config.Layout, res.StatusCode, digest, bytesDigest(manifest))
+		} else if ct := res.Header.Get("Content-Type"); ct != MediaTypeManifest {
+			t.Errorf("%s: manifest served as %s", config.Layout, ct)
+		}
+
+		for _, ref := range []string{"v1", digest} {
+			res, b = getRegistry(t, srv, "HEAD", "/v2/team/app/manifests/"+ref)
+			if res.StatusCode != http.StatusOK || len(b) != 0 || res.Header.Get("Docker-Content-Digest") != digest || res.Header.Get("Content-Length") != strconv.Itoa(len(manifest)) {
+				t.Errorf("%s: HEAD manifest %s replied %d, digest %s, length %s, %d bytes", config.Layout, ref, res.StatusCode, res.Header.Get("Docker-Content-Digest"), res.Header.Get("Content-Length"), len(b))
+			}
+		}
+
+		res, b = getRegistry(t, srv, "GET", "/v2/team/app/manifests/"+digest)
+		if res.StatusCode != http.StatusOK || string(b) != string(manifest) {
+			t.Errorf("%s: manifest by digest replied %d: %s", config.Layout, res.StatusCode, b)
+		}
+
+		var cm casManifest
+		if err := json.Unmarshal(manifest, &cm); err != nil {
+			t.Fatal(err)
+		} else if cm.Config.Digest != imageDigest(id) || len(cm.Layers) != 2 {
+			t.Fatalf("%s: manifest names config %s and %d layers, pushed %s and 2", config.Layout, cm.Config.Digest, len(cm.Layers), imageDigest(id))
+		}
+
+		// every blob it names
+		for _, desc := range append([]descriptor{cm.Config}, cm.Layers...) {
+			res, b = getRegistry(t, srv, "GET", "/v2/team/app/blobs/"+desc.Digest)
+			if res.StatusCode != http.StatusOK || bytesDigest(b) != desc.Digest || int64(len(b)) != desc.Size {
+				t.Errorf("%s: blob %s replied %d with %d bytes hashing to %s", config.Layout, desc.Digest, res.StatusCode, len(b), bytesDigest(b))
+			}
+		}
+
+		// and what isn't there, each in its route's terms
+		missing := map[string]string{
+			"/v2/team/app/manifests/v3":                  "MANIFEST_UNKNOWN",
+			"/v2/team/app/manifests/" + bytesDigest(nil): "MANIFEST_UNKNOWN",
+			"/v2/team/app/blobs/" + bytesDigest(nil):     "BLOB_UNKNOWN",
+			"/v2/team/db/blobs/" + cm.Layers[1].Digest:   "BLOB_UNKNOWN",
+			"/v2/team/app/blobs/uploads/nope":            "BLOB_UPLOAD_UNKNOWN",
+			"/v2/team/web/tags/list":                     "NAME_UNKNOWN",
+		}
+
+		for path, code := range missing {
+			res, b = getRegistry(t, srv, "GET", path)
+			if res.StatusCode != http.StatusNotFound || registryErrorCode(b) != code {
+				t.Errorf("%s: %s replied %d %s, expected 404 %s", config.Layout, path, res.StatusCode, registryErrorCode(b), code)
+			}
+		}
+	}
+}
+
+func TestRegistryReportsDamagedImagesAsMissing(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{Layout: LayoutLegacy, Compression: CompressionNone})
+	defer cleanup()
+
+	id := pushSave(t, remote, "team/app:v1", "base")
+
+	// an image whose config has gone missing from the remote
+	root := remote.(*FilesystemRemote).root
+	if err := os.Remove(filepath.Join(root, "images", id.String(), "json")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(NewRegistryHandler(remote))
+	defer srv.Close()
+
+	routes := map[string]string{
+		"/v2/team/app/manifests/v1":             "MANIFEST_UNKNOWN",
+		"/v2/team/app/blobs/" + imageDigest(id): "BLOB_UNKNOWN",
+	}
+
+	for path, code := range routes {
+		res, b := getRegistry(t, srv, "GET", path)
+		if res.StatusCode != http.StatusNotFound || registryErrorCode(b) != code {
+			t.Errorf("%s replied %d %s, expected 404 %s", path, res.StatusCode, registryErrorCode(b), code)
+		}
+	}
+}
+
+func TestRegistryFailsWithTheRoutesCode(t *testing.T) {
+	reg := &registry{}
+
+	cases := []struct {
+		err      error
+		notFound string
+		status   int
+		code     string
+	}{
+		{ErrBlobNotFound, "BLOB_UNKNOWN", http.StatusNotFound, "BLOB_UNKNOWN"},
+		{ErrBlobNotFound, "BLOB_UPLOAD_UNKNOWN", http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN"},
+		{ErrNoSuchImage, "MANIFEST_UNKNOWN", http.StatusNotFound, "MANIFEST_UNKNOWN"},
+		{ErrBlobNotFound, "", http.StatusInternalServerError, "UNKNOWN"},
+		{ErrDigestMismatch, "BLOB_UNKNOWN", http.StatusInternalServerError, "UNKNOWN"},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		reg.failed(rec, c.err, c.notFound)
+
+		if rec.Code != c.status || registryErrorCode(rec.Body.Bytes()) != c.code {
+			t.Errorf("%v on a route whose not found is %q: replied %d %s, expected %d %s", c.err, c.notFound, rec.Code, registryErrorCode(rec.Body.Bytes()), c.status, c.code)
+		}
+	}
+}
+
+func TestRegistryRefusesNamesOutsideTheGrammar(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{Layout: LayoutLegacy, Compression: CompressionNone})
+	defer cleanup()
+
+	id := pushSave(t, remote, "team/app:v1", "base")
+	manifest := filepath.Join(remote.(*FilesystemRemote).root, "images", id.String(), "manifest.json")
+	before, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := NewRegistryHandler(remote)
+
+	requests := map[string]string{
+		"/v2/../images/" + id.String() + "/manifests/v1": "NAME_INVALID",
+		"/v2/team/../images/manifests/v1":                "NAME_INVALID",
+		"/v2/team//app/manifests/v1":                     "NAME_INVALID",
+		"/v2/Team/App/manifests/v1":                      "NAME_INVALID",
+		"/v2/team/app/manifests/..":                      "TAG_INVALID",
+		"/v2/team/app/manifests/.v1":                     "TAG_INVALID",
+	}
+
+	for path, code := range requests {
+		for _, method := range []string{"GET", "PUT"} {
+			rec := httptest.NewRecorder()
+			reg.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader("{}")))
+
+			if rec.Code != http.StatusBadRequest || registryErrorCode(rec.Body.Bytes()) != code {
+				t.Errorf("%s %s replied %d %s, expected 400 %s", method, path, rec.Code, registryErrorCode(rec.Body.Bytes()), code)
+			}
+		}
+	}
+
+	if after, err := ioutil.ReadFile(manifest); err != nil || string(after) != string(before) {
+		t.Errorf("manifest.json of image %s changed: %v", id.Short(), err)
+	}
+}
+
+func TestTagRefusesNamesOutsideRefs(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{Layout: LayoutLegacy, Compression: CompressionNone})
+	defer cleanup()
+
+	id := pushSave(t, remote, "team/app:v1", "base")
+
+	for _, tag := range []string{"../images/" + id.String() + ":manifest.json", "team//app:v1", "team/app:..", "./app:v1"} {
+		if _, err := remote.Tag("team/app:v1", tag, ""); err == nil {
+			t.Errorf("tagged the image as %s", tag)
+		}
+	}
+
+	refs, err := remote.Images()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 1 {
+		t.Errorf("expected only team/app:v1, found %d tags", len(refs))
+	}
+}
+
+func TestRegistryTakesBlobsWholeAndInChunks(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{Layout: LayoutLegacy, Compression: CompressionNone})
+	defer cleanup()
+
+	srv := httptest.NewServer(NewRegistryHandler(remote))
+	defer srv.Close()
+
+	whole, chunked := []byte("sent in one go"), []byte("sent in three chunks")
+
+	// monolithic, and with a digest it doesn't have
+	res, b := sendRegistry(t, srv, "POST", "/v2/team/app/blobs/uploads/?digest="+bytesDigest(nil), nil, whole)
+	if res.StatusCode != http.StatusBadRequest || registryErrorCode(b) != "DIGEST_INVALID" {
+		t.Errorf("mismatched monolithic upload replied %d %s", res.StatusCode, registryErrorCode(b))
+	}
+
+	res, _ = sendRegistry(t, srv, "POST", "/v2/team/app/blobs/uploads/?digest="+bytesDigest(whole), nil, whole)
+	if res.StatusCode != http.StatusCreated || res.Header.Get("Docker-Content-Digest") != bytesDigest(whole) {
+		t.Fatalf("monolithic upload replied %d, digest %s", res.StatusCode, res.Header.Get("Docker-Content-Digest"))
+	}
+
+	// chunked: PATCH, PATCH, and the rest with PUT
+	res, _ = sendRegistry(t, srv, "POST", "/v2/team/app/blobs/uploads/", nil, nil)
+	location := res.Header.Get("Location")
+	if res.StatusCode != http.StatusAccepted || location == "" {
+		t.Fatalf("starting an upload replied %d, location %q", res.StatusCode, location)
+	}
+
+	res, _ = sendRegistry(t, srv, "PATCH", location, map[string]string{"Content-Range": "0-4"}, chunked[:5])
+	if res.StatusCode != http.StatusAccepted || res.Header.Get("Range") != "0-4" {
+		t.Fatalf("first chunk replied %d, range %s", res.StatusCode, res.Header.Get("Range"))
+	}
+
+	// a chunk that doesn't carry on from there is refused, and nothing changes
+	res, b = sendRegistry(t, srv, "PATCH", location, map[string]string{"Content-Range": "0-4"}, chunked[:5])
+	if res.StatusCode != http.StatusRequestedRangeNotSatisfiable || registryErrorCode(b) != "BLOB_UPLOAD_INVALID" || res.Header.Get("Range") != "0-4" {
+		t.Errorf("overlapping chunk replied %d %s, range %s", res.StatusCode, registryErrorCode(b), res.Header.Get("Range"))
+	}
+
+	res, _ = sendRegistry(t, srv, "PATCH", location, map[string]string{"Content-Range": "5-11"}, chunked[5:12])
+	if res.StatusCode != http.StatusAccepted || res.Header.Get("Range") != "0-11" {
+		t.Fatalf("second chunk replied %d, range %s", res.StatusCode, res.Header.Get("Range"))
+	}
+
+	res, _ = getRegistry(t, srv, "GET", location)
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Range") != "0-11" {
+		t.Errorf("upload status replied %d, range %s", res.StatusCode, res.Header.Get("Range"))
+	}
+
+	res, _ = sendRegistry(t, srv, "PUT", location+"?digest="+bytesDigest(chunked), nil, chunked[12:])
+	if res.StatusCode != http.StatusCreated || res.Header.Get("Docker-Content-Digest") != bytesDigest(chunked) {
+		t.Fatalf("finishing the upload replied %d, digest %s", res.StatusCode, res.Header.Get("Docker-Content-Digest"))
+	}
+
+	// a chunked upload that doesn't hash to the digest it's finished with
+	res, _ = sendRegistry(t, srv, "POST", "/v2/team/app/blobs/uploads/", nil, nil)
+	res, b = sendRegistry(t, srv, "PUT", res.Header.Get("Location")+"?digest="+bytesDigest(nil), nil, chunked)
+	if res.StatusCode != http.StatusBadRequest || registryErrorCode(b) != "DIGEST_INVALID" {
+		t.Errorf("mismatched chunked upload replied %d %s", res.StatusCode, registryErrorCode(b))
+	}
+
+	for _, blob := range [][]byte{whole, chunked} {
+		res, b = getRegistry(t, srv, "GET", "/v2/team/app/blobs/"+bytesDigest(blob))
+		if res.StatusCode != http.StatusOK || string(b) != string(blob) {
+			t.Errorf("blob %s replied %d: %q", bytesDigest(blob), res.StatusCode, b)
+		}
+	}
+
+	res, b = getRegistry(t, srv, "GET", "/v2/team/app/blobs/"+bytesDigest(nil))
+	if res.StatusCode != http.StatusNotFound || registryErrorCode(b) != "BLOB_UNKNOWN" {
+		t.Errorf("blob whose upload failed replied %d %s", res.StatusCode, registryErrorCode(b))
+	}
+}
+
+func TestRegistryPushThenPull(t *testing.T) {
+	for _, config := range []Config{{Layout: LayoutLegacy, Compression: CompressionNone}, {Layout: LayoutCAS, Compression: CompressionZstd}} {
+		remote, cleanup := newTestRemote(t, config)
+		defer cleanup()
+
+		srv := httptest.NewServer(NewRegistryHandler(remote))
+		defer srv.Close()
+
+		// one layer as is, and one gzipped
+		base, top := []byte("base layer.tar"), []byte("top layer.tar")
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write(top)
+		zw.Close()
+
+		imageConfig, _ := json.Marshal(map[string]interface{}{
+			"rootfs": map[string]interface{}{"type": "layers", "diff_ids": []string{bytesDigest(base), bytesDigest(top)}},
+		})
+
+		blobs := [][]byte{imageConfig, base, gz.Bytes()}
+		for _, blob := range blobs {
+			res, _ := sendRegistry(t, srv, "POST", "/v2/team/app/blobs/uploads/?digest="+bytesDigest(blob), nil, blob)
+			if res.StatusCode != http.StatusCreated {
+				t.Fatalf("%s: uploading %s replied %d", config.Layout, bytesDigest(blob), res.StatusCode)
+			}
+		}
+
+		m := casManifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeManifest,
+			Config:        descriptor{MediaType: MediaTypeConfig, Size: int64(len(imageConfig)), Digest: bytesDigest(imageConfig)},
+			Layers: []descriptor{
+				{MediaType: MediaTypeLayer, Size: int64(len(base)), Digest: bytesDigest(base)},
+				{MediaType: MediaTypeLayerGzip, Size: int64(gz.Len()), Digest: bytesDigest(gz.Bytes())},
+			},
+		}
+
+		// sizes that don't match the blobs are refused
+		m.Layers[0].Size++
+		body, _ := json.Marshal(m)
+		res, b := sendRegistry(t, srv, "PUT", "/v2/team/app/manifests/v1", map[string]string{"Content-Type": MediaTypeManifest}, body)
+		if res.StatusCode != http.StatusBadRequest || registryErrorCode(b) != "MANIFEST_INVALID" {
+			t.Errorf("%s: manifest with a wrong size replied %d %s", config.Layout, res.StatusCode, registryErrorCode(b))
+		}
+
+		m.Layers[0].Size--
+		body, _ = json.Marshal(m)
+		res, b = sendRegistry(t, srv, "PUT", "/v2/team/app/manifests/v1", map[string]string{"Content-Type": MediaTypeManifest}, body)
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("%s: manifest replied %d: %s", config.Layout, res.StatusCode, b)
+		}
+
+		var loaded map[string][]byte
+		pulled, err := remote.Pull("team/app:v1", func(ID) (bool, error) { return false, nil }, func(r io.Reader) (err error) {
+			loaded, err = readTar(r)
+			return err
+		})
+
+		if err != nil {
+			t.Fatalf("%s: could not pull: %v", config.Layout, err)
+		} else if pulled.Id != ID(ID(bytesDigest(imageConfig)).String()) {
+			t.Errorf("%s: pulled image %s, pushed %s", config.Layout, pulled.Id.Short(), ID(bytesDigest(imageConfig)).Short())
+		}
+
+		sm, err := decodeManifest(bytes.NewReader(loaded["manifest.json"]))
+		if err != nil {
+			t.Fatalf("%s: could not read manifest.json: %v", config.Layout, err)
+		} else if len(sm.Layers) != 2 || string(loaded[sm.Layers[0]]) != string(base) || string(loaded[sm.Layers[1]]) != string(top) {
+			t.Errorf("%s: pulled layers %v", config.Layout, sm.Layers)
+		}
+	}
+}
+
+func TestRegistryServesWhatPushSent(t *testing.T) {
+	for _, config := range []Config{{Layout: LayoutLegacy, Compression: CompressionGzip}, {Layout: LayoutCAS, Compression: CompressionZstd}} {
+		remote, cleanup := newTestRemote(t, config)
+		defer cleanup()
+
+		contents := []string{"base", "top"}
+		pushSave(t, remote, "team/app:v1", contents...)
+
+		srv := httptest.NewServer(NewRegistryHandler(remote))
+		defer srv.Close()
+
+		// as a client pulling it would: the manifest, the config it names,
+		// and each layer, checked against the config's diff_ids
+		_, b := getRegistry(t, srv, "GET", "/v2/team/app/manifests/v1")
+
+		var m casManifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatalf("%s: could not read manifest: %v", config.Layout, err)
+		}
+
+		_, b = getRegistry(t, srv, "GET", "/v2/team/app/blobs/"+m.Config.Digest)
+
+		var ic imageConfig
+		if err := json.Unmarshal(b, &ic); err != nil || len(ic.RootFS.DiffIDs) != len(contents) || len(m.Layers) != len(contents) {
+			t.Fatalf("%s: config lists %d layers and the manifest %d: %v", config.Layout, len(ic.RootFS.DiffIDs), len(m.Layers), err)
+		}
+
+		for i, layer := range m.Layers {
+			res, b := getRegistry(t, srv, "GET", "/v2/team/app/blobs/"+layer.Digest)
+			codec, err := layerCodec(layer.MediaType)
+			if res.StatusCode != http.StatusOK || err != nil || codec != config.Compression {
+				t.Fatalf("%s: layer %d replied %d as %s: %v", config.Layout, i, res.StatusCode, layer.MediaType, err)
+			}
+
+			f, err := decompressor(layer.Digest, codec, ioutil.NopCloser(bytes.NewReader(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tarball, err := ioutil.ReadAll(f)
+			if err != nil || string(tarball) != contents[i] || bytesDigest(tarball) != ic.RootFS.DiffIDs[i] {
+				t.Errorf("%s: layer %d is %q, pushed %q: %v", config.Layout, i, tarball, contents[i], err)
+			}
+		}
+	}
+}
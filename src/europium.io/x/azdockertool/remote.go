@@ -1,9 +1,16 @@
 package azdockertool
 
 import (
+	"fmt"
+	"io"
 	"time"
 )
 
+const (
+	RemoteTypeAzure      string = "azure"
+	RemoteTypeFilesystem string = "filesystem"
+)
+
 type ImageInfo struct {
 	Repository   string
 	Tag          string
@@ -14,17 +21,104 @@ type ImageInfo struct {
 
 type PullResult struct {
 	Id         ID
-	Repository string
+	Repository string // empty when pulled by image ID
 	Tag        string
-	Src        string
+	Present    bool // the Docker host already had the image, so nothing was downloaded
+}
+
+const (
+	LayerFound   = "found"   // already in the remote
+	LayerSent    = "sent"    // uploaded by this push
+	LayerFailed  = "failed"  // upload failed
+	LayerSkipped = "skipped" // not attempted because another upload failed
+)
+
+type LayerStatus struct {
+	Id     ID
+	Status string
 }
 
 type PushResult struct {
+	Layers []LayerStatus // in manifest order (or save order, if the push failed)
+}
+
+type RmiResult struct {
+	Untagged []string
+	Deleted  []string
+	DryRun   bool
+}
+
+type GCResult struct {
+	MarkedImages int
+	MarkedLayers int
+	Deleted      []string
+	Retained     []string // unreachable, but still within the grace period
+	DryRun       bool
+}
+
+type VerifyProblem struct {
+	Kind     string // one of the Problem* constants
+	Name     string // the blob (or blob prefix) concerned
+	Detail   string
+	Repaired bool
+}
+
+type VerifyResult struct {
+	Refs     int // how many of each were checked
+	Images   int
+	Layers   int
+	Problems []*VerifyProblem
+}
+
+type MigrateResult struct {
+	Images  []ID     // rewritten into the content addressed layout
+	Layers  []ID     // copied into blobs/sha256/
+	Deleted []string // legacy blobs nothing needs any more
+	DryRun  bool
+}
+
+type CopyResult struct {
+	Id         ID
+	Repository string // as tagged in the destination
+	Tag        string
+	Present    bool          // the destination already had the image, so nothing was copied
+	Layers     []LayerStatus // in manifest order
+}
+
+type SyncResult struct {
+	Copied    []string // tags whose image was copied, as "{repository}:{tag}"
+	Tagged    []string // tags whose image the destination already had
+	Deleted   []string // tags pruned from the destination
+	Kept      []string // tags not pruned, having changed in the destination meanwhile
+	Unchanged int
+	Layers    int // sent
+	DryRun    bool
 }
 
 type Remote interface {
 	Images() ([]*ImageInfo, error)
-	Pull(query string, known func(id ID) (bool, error), localStorage *LocalStorage) (*PullResult, error)
-	// Graph() (*LayerGraph, error)
-	Push(query string, exporter func(dir, repository string) error, localStorage *LocalStorage) (*PushResult, error)
+	Pull(query string, known func(id ID) (bool, error), importer func(r io.Reader) error) (*PullResult, error)
+	Graph() (*LayerGraph, error)
+	Rmi(query string, force, dryRun bool) (*RmiResult, error)
+	GC(grace time.Duration, dryRun bool) (*GCResult, error)
+	Push(query string, exporter func(repository string, w io.Writer) error, expect ID) (*PushResult, error)
+	Verify(deep, repair bool) (*VerifyResult, error)
+	Migrate(dryRun bool) (*MigrateResult, error)
+	RegistryImage(query string) (*RegistryImage, error)
+	RegistryUploads() *RegistryUploads
+	Copy(query string, dst Remote, tag string, expect ID) (*CopyResult, error)
+	Sync(dst Remote, patterns []string, prune, dryRun bool) (*SyncResult, error)
+	Tag(query, tag string, expect ID) (ID, error)
+}
+
+// Returns the backend selected by the environment's type
+func NewRemote(config *Config) (Remote, error) {
+	switch config.Type {
+	case "", RemoteTypeAzure:
+		return NewAzureBlobStorageRemote(config)
+	case RemoteTypeFilesystem:
+		return NewFilesystemRemote(config)
+	default:
+		return nil, fmt.Errorf("unknown remote type '%s'", config.Type)
+	}
 }
@@ -0,0 +1,180 @@
+package azdockertool
+
+import (
+	"fmt"
+	sdk "github.com/Azure/azure-sdk-for-go/storage"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var (
+	// the SDK reports error responses without a body only as text
+	bodylessStatus = regexp.MustCompile(`without a response body \((\d{3})`)
+)
+
+// RetryPolicy says how hard to try a storage operation before giving up
+type RetryPolicy struct {
+	MaxAttempts int           // including the first; 1 disables retries
+	Backoff     time.Duration // before the first retry; doubles after each one
+	MaxBackoff  time.Duration
+}
+
+// Returns the retry policy used when an environment doesn't override it
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: DefaultRetryAttempts,
+		Backoff:     DefaultRetryBackoff,
+		MaxBackoff:  DefaultRetryMaxBackoff,
+	}
+}
+
+// Calls fn until it succeeds, fails with an error that isn't worth retrying,
+// or runs out of attempts
+func (p RetryPolicy) do(op, name string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !isRetryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+
+		delay := p.delay(attempt)
+
+		log.WithFields(log.Fields{
+			"operation": op,
+			"name":      name,
+			"attempt":   attempt,
+			"of":        p.MaxAttempts,
+			"delay":     delay.String(),
+			"reason":    err.Error(),
+		}).Warn("retrying")
+
+		time.Sleep(delay)
+	}
+}
+
+// Returns how long to wait after a failed attempt: exponential, capped at
+// MaxBackoff, with half of it jittered so that parallel transfers which
+// failed together don't retry together
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Returns whether an error from the storage service (or the network between
+// us) is transient, as opposed to something retrying won't fix
+func isRetryable(err error) bool {
+	switch e := err.(type) {
+	case sdk.AzureStorageServiceError:
+		return isRetryableStatus(e.StatusCode)
+	case sdk.UnexpectedStatusCodeError:
+		return isRetryableStatus(e.Got())
+	case *url.Error:
+		return isRetryable(e.Err)
+	case *net.OpError:
+		return true
+	case *os.SyscallError:
+		return isRetryable(e.Err)
+	case net.Error:
+		return e.Timeout()
+	case syscall.Errno:
+		return e == syscall.ECONNRESET || e == syscall.ECONNREFUSED || e == syscall.EPIPE || e == syscall.ETIMEDOUT
+	}
+
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// the connection closed under us
+		return true
+	}
+
+	if m := bodylessStatus.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return isRetryableStatus(code)
+	}
+
+	return false
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == 429 || code >= 500
+}
+
+// retryingReader reads a blob, reopening it where it left off when the
+// connection fails part way through
+type retryingReader struct {
+	ar     *absremote
+	name   string
+	body   io.ReadCloser
+	offset int64
+	tries  int
+}
+
+func (r *retryingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+
+	if err == nil || err == io.EOF || !isRetryable(err) {
+		return n, err
+	}
+
+	r.tries++
+	if r.tries >= r.ar.config.Retry.MaxAttempts {
+		return n, err
+	}
+
+	log.WithFields(log.Fields{
+		"operation": "GetBlob",
+		"name":      r.name,
+		"attempt":   r.tries,
+		"of":        r.ar.config.Retry.MaxAttempts,
+		"offset":    r.offset,
+		"reason":    err.Error(),
+	}).Warn("resuming download")
+
+	r.body.Close()
+	time.Sleep(r.ar.config.Retry.delay(r.tries))
+
+	var body io.ReadCloser
+	rerr := r.ar.config.Retry.do("GetBlob", r.name, func() (err error) {
+		body, err = r.ar.blobStorage.GetBlobRange(r.ar.container, r.name, fmt.Sprintf("%d-", r.offset))
+		return err
+	})
+
+	if rerr != nil {
+		r.body = eofReader{}
+		return n, rerr
+	}
+
+	r.body = body
+	return n, nil
+}
+
+func (r *retryingReader) Close() error {
+	return r.body.Close()
+}
+
+// eofReader stands in for a body that couldn't be reopened
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+func (eofReader) Close() error             { return nil }
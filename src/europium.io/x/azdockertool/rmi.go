@@ -0,0 +1,214 @@
+package azdockertool
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+)
+
+var (
+	ErrImageHasTags error = errors.New("image is referenced by one or more tags; use --force to remove them")
+)
+
+// Removes a tag (or, with force, an image ID and all of its tags) from the
+// remote, then deletes whatever images and layers are no longer referenced.
+//
+// Note that this does not lock the container; removing an image while another
+// client is pushing one that shares its layers may leave the new image broken.
+func (l *layout) Rmi(query string, force, dryRun bool) (*RmiResult, error) {
+	perms := "rl"
+	if !dryRun {
+		perms += "d"
+	}
+
+	if err := l.checkPermissions("rmi", perms); err != nil {
+		return nil, err
+	}
+
+	// a manifest or tag skipped here could leave layers it needs looking
+	// unshared, so anything unreadable stops rmi, as it stops gc
+	g, err := l.graph(true)
+	if err != nil {
+		return nil, err
+	}
+
+	// resolve the query to the refs we're removing and the image they point at
+	img, untag, err := resolveRmiQuery(g, query, force)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &RmiResult{DryRun: dryRun}
+	doomed := make(map[string]bool)
+
+	for _, ref := range untag {
+		res.Untagged = append(res.Untagged, fmt.Sprintf("%s:%s", ref.Repository, ref.Tag))
+		res.Deleted = append(res.Deleted, ref.Root)
+		doomed[ref.Root] = true
+	}
+
+	// keep the image if anything still points at it
+	for _, ref := range g.Refs {
+		if ref.Id == img && !doomed[ref.Root] {
+			return l.applyRmi(res)
+		}
+	}
+
+	// the image goes; manifest.json first so nobody mistakes it for a whole image
+	names, err := l.listBlobNames(fmt.Sprintf("images/%s/", img))
+	if err != nil {
+		return nil, err
+	}
+
+	res.Deleted = append(res.Deleted, manifestFirst(names)...)
+
+	// and its config, if it's content addressed
+	names, err = l.listBlobNames(blobPath(string(img)))
+	if err != nil {
+		return nil, err
+	}
+
+	res.Deleted = append(res.Deleted, names...)
+
+	// then every layer no surviving manifest refers to
+	node, ok := g.Images[img]
+	if !ok {
+		return l.applyRmi(res)
+	}
+
+	shared := make(map[ID]bool)
+	for id, other := range g.Images {
+		if id == img {
+			continue
+		}
+
+		for _, lid := range other.Layers {
+			shared[lid] = true
+		}
+	}
+
+	unlinked := make(map[ID]bool)
+	for _, lid := range node.Layers {
+		if shared[lid] {
+			continue
+		}
+
+		names, err := l.listBlobNames(fmt.Sprintf("layers/%s/", lid))
+		if err != nil {
+			return nil, err
+		}
+
+		res.Deleted = append(res.Deleted, names...)
+
+		names, err = l.listBlobNames(blobPath(string(lid)))
+		if err != nil {
+			return nil, err
+		}
+
+		res.Deleted = append(res.Deleted, names...)
+		if len(names) > 0 {
+			unlinked[lid] = true
+		}
+
+		shared[lid] = true // a manifest may list the same layer twice
+	}
+
+	if len(unlinked) == 0 {
+		return l.applyRmi(res)
+	}
+
+	// along with the links naming the layer blobs that went
+	links, err := l.listBlobNames(linkSearchPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range links {
+		if _, digest, ok := splitObjectPath(linkSearchPrefix, name); ok && unlinked[ID(digest)] {
+			res.Deleted = append(res.Deleted, name)
+		}
+	}
+
+	return l.applyRmi(res)
+}
+
+// deletes the blobs named in the result, unless this is a dry run
+func (l *layout) applyRmi(res *RmiResult) (*RmiResult, error) {
+	if res.DryRun {
+		return res, nil
+	}
+
+	for _, name := range res.Deleted {
+		if err := l.store.deleteBlob(name); err != nil {
+			log.WithFields(log.Fields{
+				"path":     name,
+				"rollback": false,
+			}).Error("failed to delete blob")
+			return nil, err
+		}
+
+		if l.config.Verbose {
+			log.WithFields(log.Fields{
+				"path": name,
+			}).Info("deleted blob")
+		}
+	}
+
+	return res, nil
+}
+
+// Resolves a tag or (partial) image ID to an image and the refs to remove
+func resolveRmiQuery(g *LayerGraph, query string, force bool) (ID, []*ImageInfo, error) {
+	// by tag
+	repo, tag := toRepositoryAndTag(query)
+	for _, ref := range g.Refs {
+		if ref.Repository == repo && ref.Tag == tag {
+			return ref.Id, []*ImageInfo{ref}, nil
+		}
+	}
+
+	// by (partial) image ID
+	hash := strings.TrimPrefix(query, "sha256:")
+	var matches []ID
+	for id := range g.Images {
+		if strings.HasPrefix(id.String(), hash) {
+			matches = append(matches, id)
+		}
+	}
+
+	if len(matches) == 0 {
+		return "", nil, ErrNoSuchImage
+	} else if len(matches) > 1 {
+		return "", nil, ErrMultipleResults
+	}
+
+	img := matches[0]
+
+	var refs []*ImageInfo
+	for _, ref := range g.Refs {
+		if ref.Id == img {
+			refs = append(refs, ref)
+		}
+	}
+
+	if len(refs) > 0 && !force {
+		return "", nil, ErrImageHasTags
+	}
+
+	return img, refs, nil
+}
+
+// Orders blob names so that any manifest.json comes first
+func manifestFirst(names []string) []string {
+	var head, tail []string
+	for _, name := range names {
+		if strings.HasSuffix(name, "/manifest.json") {
+			head = append(head, name)
+		} else {
+			tail = append(tail, name)
+		}
+	}
+
+	return append(head, tail...)
+}
@@ -0,0 +1,457 @@
+package azdockertool
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBlobNotFound error = errors.New("blob not found")
+
+	// a conditional write found the blob changed
+	errPreconditionFailed error = errors.New("blob changed since it was read")
+)
+
+const (
+	// blobs at least this big are downloaded in ranges, in parallel, ahead of
+	// whatever is reading them
+	rangedFetchThreshold int64 = 4 * MaxBlobBlockSize
+	rangedFetchSize      int64 = MaxBlobBlockSize
+)
+
+// blobInfo describes a single blob in a remote
+type blobInfo struct {
+	Name         string
+	Size         int64
+	LastModified time.Time
+	ContentMD5   string // base64, when the store knows it
+}
+
+// blobstore is the flat, prefix-listable namespace a remote keeps its
+// layers/, images/ and refs/ tree in (see pkg.go)
+type blobstore interface {
+	// lists every blob whose name starts with prefix, in lexical order
+	listBlobs(prefix string) ([]blobInfo, error)
+
+	// opens a blob for reading; returns ErrBlobNotFound if it doesn't exist
+	openBlob(name string) (io.ReadCloser, error)
+
+	// creates or replaces a blob with the contents of r
+	putBlob(name string, r io.Reader) error
+
+	// deletes a blob; deleting a blob that doesn't exist is not an error
+	deleteBlob(name string) error
+}
+
+// rangeReader is implemented by blobstores that can read part of a blob, so
+// that large blobs can be downloaded in parallel pieces
+type rangeReader interface {
+	openBlobRange(name string, offset, length int64) (io.ReadCloser, error)
+}
+
+// metadataStore is implemented by blobstores that can keep a few key/value
+// pairs alongside a blob
+type metadataStore interface {
+	getBlobMetadata(name string) (map[string]string, error)
+	setBlobMetadata(name string, meta map[string]string) error
+}
+
+// blobCopier is implemented by blobstores that can copy a blob without
+// downloading it
+type blobCopier interface {
+	copyBlob(src, dst string) error
+}
+
+// remoteCopier is implemented by blobstores that can copy a blob from another
+// remote's store without downloading it, given one they can read from;
+// they return false if they can't
+type remoteCopier interface {
+	copyRemoteBlob(src blobstore, name string) (bool, error)
+}
+
+// conditionalStore is implemented by blobstores that can replace a small blob
+// only if it hasn't changed since it was read, atomically
+type conditionalStore interface {
+	// reads a blob, and the ETag it had; ErrBlobNotFound if it doesn't exist
+	getBlobETag(name string) ([]byte, string, error)
+
+	// writes a blob if it still has the given ETag (If-Match) or, given none,
+	// if it doesn't exist (If-None-Match: *); errPreconditionFailed if not
+	putBlobIfMatch(name string, b []byte, etag string) error
+
+	// deletes a blob if it still has the given ETag; errPreconditionFailed if
+	// it's changed, but deleting a blob that's gone is not an error
+	deleteBlobIfMatch(name, etag string) error
+}
+
+// permissionChecker is implemented by blobstores whose credentials may be
+// scoped down, so that an operation can fail before it's half done
+type permissionChecker interface {
+	// perms uses the SAS permission letters, e.g. "wd" for write and delete
+	requirePermissions(op, perms string) error
+}
+
+// PermissionError is returned when the configured credentials don't grant
+// what an operation needs
+type PermissionError struct {
+	Op      string
+	Missing []string
+	Granted string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s requires %s permission, but the SAS token only grants '%s'",
+		e.Op, strings.Join(e.Missing, " and "), e.Granted)
+}
+
+// layout implements Remote on top of any blobstore
+type layout struct {
+	config *Config
+	store  blobstore
+}
+
+// Checks the store's credentials allow an operation, if it can tell
+func (l *layout) checkPermissions(op, perms string) error {
+	if pc, ok := l.store.(permissionChecker); ok {
+		return pc.requirePermissions(op, perms)
+	}
+
+	return nil
+}
+
+// Retrieves a blob and interprets it as a string
+func (l *layout) GetBlobAsString(path string) (string, error) {
+	f, err := l.store.openBlob(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	// Read until null terminator
+	buf := bufio.NewReader(f)
+	ys, err := buf.ReadBytes(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	if err == io.EOF {
+		return string(ys), nil
+	}
+
+	// Don't return the null terminator
+	return string(ys[:len(ys)-1]), nil
+}
+
+// Downloads a whole blob
+func (l *layout) getBlob(path string) ([]byte, error) {
+	f, err := l.store.openBlob(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not download '%s': %v", path, err)
+	}
+
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// Downloads a blob and decodes it as JSON
+func (l *layout) getJSON(path string, v interface{}) error {
+	f, err := l.store.openBlob(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return json.NewDecoder(f).Decode(v)
+}
+
+// Downloads and decodes an images/{id}/manifest.json blob, in either layout
+func (l *layout) getManifest(path string) (*manifest, error) {
+	f, err := l.store.openBlob(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRemoteManifest(b)
+}
+
+// Lists the names of all blobs sharing a prefix
+func (l *layout) listBlobNames(prefix string) ([]string, error) {
+	blobs, err := l.store.listBlobs(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, item := range blobs {
+		names = append(names, item.Name)
+	}
+
+	return names, nil
+}
+
+// Lists a single blob; returns ErrBlobNotFound if it doesn't exist
+func (l *layout) statBlob(name string) (blobInfo, error) {
+	blobs, err := l.store.listBlobs(name)
+	if err != nil {
+		return blobInfo{}, err
+	}
+
+	for _, item := range blobs {
+		if item.Name == name {
+			return item, nil
+		}
+	}
+
+	return blobInfo{}, ErrBlobNotFound
+}
+
+// Opens a listed blob for reading, in parallel ranges if it's big enough and
+// the store can. What's read is checked against the listing's size and MD5
+// (when known) and the given digest: the final read fails instead of
+// returning io.EOF if any of them don't match. Without a digest to expect,
+// the one push recorded (if the store keeps metadata) is used.
+func (l *layout) openVerified(item blobInfo, digest string) (io.ReadCloser, error) {
+	if ms, ok := l.store.(metadataStore); ok && digest == "" {
+		meta, err := ms.getBlobMetadata(item.Name)
+		if err != nil {
+			return nil, fmt.Errorf("could not read metadata of '%s': %v", item.Name, err)
+		}
+
+		digest = meta[digestMetadataKey]
+	}
+
+	var src io.ReadCloser
+	if rr, ok := l.store.(rangeReader); ok && item.Size >= rangedFetchThreshold {
+		src = l.newRangedReader(rr, item)
+	} else {
+		f, err := l.store.openBlob(item.Name)
+		if err != nil {
+			return nil, fmt.Errorf("could not download '%s': %v", item.Name, err)
+		}
+
+		src = f
+	}
+
+	return newVerifyingReader(src, item, digest), nil
+}
+
+// Downloads a whole listed blob, checking it as openVerified does
+func (l *layout) getVerified(item blobInfo) ([]byte, error) {
+	f, err := l.openVerified(item, "")
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// verifyingReader checks a blob has the size and MD5 the store listed, and the
+// digest expected of it, as it's read
+type verifyingReader struct {
+	src  io.Closer
+	item blobInfo
+	md5  hash.Hash
+	d    *digestingReader
+	n    int64
+}
+
+func newVerifyingReader(src io.ReadCloser, item blobInfo, digest string) *verifyingReader {
+	return &verifyingReader{
+		src:  src,
+		item: item,
+		md5:  md5.New(),
+		d:    newDigestingReader(item.Name, src, digest),
+	}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.d.Read(p)
+	v.md5.Write(p[:n])
+	v.n += int64(n)
+
+	if v.n > v.item.Size {
+		return n, fmt.Errorf("download of '%s' is corrupt: expected %d bytes, got more", v.item.Name, v.item.Size)
+	}
+
+	if err != io.EOF {
+		return n, err
+	}
+
+	if v.n != v.item.Size {
+		return n, fmt.Errorf("download of '%s' is corrupt: expected %d bytes, got %d", v.item.Name, v.item.Size, v.n)
+	}
+
+	if v.item.ContentMD5 != "" {
+		sum := base64.StdEncoding.EncodeToString(v.md5.Sum(nil))
+		if sum != v.item.ContentMD5 {
+			return n, fmt.Errorf("download of '%s' is corrupt: expected MD5 %s, got %s", v.item.Name, v.item.ContentMD5, sum)
+		}
+	}
+
+	return n, io.EOF
+}
+
+func (v *verifyingReader) Close() error {
+	return v.src.Close()
+}
+
+// rangedReader reads a blob in rangedFetchSize pieces, downloading up to
+// config.Concurrency of them ahead of the reader
+type rangedReader struct {
+	rr      rangeReader
+	item    blobInfo
+	ahead   int
+	next    int // the next range to start downloading
+	count   int
+	pending []chan rangeResult // in the order they're to be read
+	buf     []byte
+	err     error
+	stop    chan struct{}
+}
+
+type rangeResult struct {
+	buf []byte
+	err error
+}
+
+func (l *layout) newRangedReader(rr rangeReader, item blobInfo) *rangedReader {
+	count := int((item.Size + rangedFetchSize - 1) / rangedFetchSize)
+
+	if l.config.Verbose {
+		log.WithFields(log.Fields{
+			"name":   item.Name,
+			"size":   item.Size,
+			"ranges": count,
+		}).Info("downloading in ranges")
+	}
+
+	ahead := l.config.Concurrency
+	if ahead < 1 {
+		ahead = 1
+	}
+
+	return &rangedReader{rr: rr, item: item, ahead: ahead, count: count, stop: make(chan struct{})}
+}
+
+func (r *rangedReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		for r.next < r.count && len(r.pending) < r.ahead {
+			r.pending = append(r.pending, r.start(r.next))
+			r.next++
+		}
+
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+
+		res := <-r.pending[0]
+		r.pending = r.pending[1:]
+		r.buf, r.err = res.buf, res.err
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Starts downloading the i'th range
+func (r *rangedReader) start(i int) chan rangeResult {
+	done := make(chan rangeResult, 1)
+
+	go func() {
+		offset := int64(i) * rangedFetchSize
+		length := rangedFetchSize
+		if offset+length > r.item.Size {
+			length = r.item.Size - offset
+		}
+
+		if stopped(r.stop) {
+			done <- rangeResult{err: io.ErrClosedPipe}
+			return
+		}
+
+		src, err := r.rr.openBlobRange(r.item.Name, offset, length)
+		if err != nil {
+			done <- rangeResult{err: fmt.Errorf("could not download '%s' (bytes %d-%d): %v", r.item.Name, offset, offset+length-1, err)}
+			return
+		}
+
+		defer src.Close()
+
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(src, buf); err != nil {
+			done <- rangeResult{err: fmt.Errorf("could not download '%s' (bytes %d-%d): %v", r.item.Name, offset, offset+length-1, err)}
+			return
+		}
+
+		done <- rangeResult{buf: buf}
+	}()
+
+	return done
+}
+
+// Stops downloading ranges that haven't started yet
+func (r *rangedReader) Close() error {
+	close(r.stop)
+	return nil
+}
+
+// Returns whether or not the remote contains a particular layer
+func (l *layout) HasLayer(id ID) (bool, error) {
+	path := fmt.Sprintf("layers/%s/", id.String())
+
+	// listing because each layer should contain 3 blobs
+	blobs, err := l.store.listBlobs(path)
+	if err != nil {
+		return false, err
+	}
+
+	if len(blobs) == 3 {
+		return true, nil
+	} else if len(blobs) == 0 {
+		return false, nil
+	} else {
+		return false, ErrIncompleteLayer
+	}
+}
+
+// Returns whether an error from a blobstore means the blob doesn't exist
+func isNotFound(err error) bool {
+	return err == ErrBlobNotFound
+}
+
+// Splits "{prefix}{id}/{name}" into its id and name
+func splitObjectPath(prefix, path string) (id ID, name string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return ID(parts[0]), parts[1], true
+}
@@ -0,0 +1,209 @@
+package azdockertool
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"path"
+	"sort"
+)
+
+// Makes another remote's tags match this one's, for the repositories
+// matching any of the glob patterns (as path.Match has them, so "team/*"
+// matches team/app but "*" doesn't); every repository if none are given.
+// Tags missing from the destination, or naming a different image there, are
+// copied as Copy does, so only missing images and layers are sent. With
+// prune, tags the destination has that this remote doesn't are deleted too,
+// each only if it hasn't changed there since it was listed; gc then reclaims
+// what they alone referred to. A dry run only reports what would be done.
+func (l *layout) Sync(dst Remote, patterns []string, prune, dryRun bool) (*SyncResult, error) {
+	d, ok := dst.(interface {
+		remoteLayout() *layout
+	})
+
+	if !ok {
+		return nil, ErrUnsupportedRemote
+	}
+
+	to := d.remoteLayout()
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+		}
+	}
+
+	perms := "rl"
+	if !dryRun {
+		perms += "w"
+		if prune {
+			perms += "d"
+		}
+	}
+
+	if err := l.checkPermissions("sync", "rl"); err != nil {
+		return nil, err
+	} else if err := to.checkPermissions("sync", perms); err != nil {
+		return nil, err
+	}
+
+	want, err := l.syncedRefs(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	have, err := to.syncedRefs(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &SyncResult{DryRun: dryRun}
+	present := make(map[ID]bool)
+
+	for _, ref := range sortedRefs(want) {
+		id := want[ref]
+		if have[ref] == id {
+			res.Unchanged++
+			continue
+		}
+
+		if _, ok := present[id]; !ok {
+			ok, err := to.hasBlob(fmt.Sprintf("images/%s/manifest.json", id))
+			if err != nil {
+				return nil, err
+			}
+
+			present[id] = ok
+		}
+
+		if dryRun {
+			if present[id] {
+				res.Tagged = append(res.Tagged, ref)
+			} else {
+				res.Copied = append(res.Copied, ref)
+			}
+
+			present[id] = true
+			continue
+		}
+
+		copied, err := l.Copy(ref, dst, ref, "")
+		if err != nil {
+			return res, fmt.Errorf("could not copy '%s': %v", ref, err)
+		}
+
+		if copied.Present {
+			res.Tagged = append(res.Tagged, ref)
+		} else {
+			res.Copied = append(res.Copied, ref)
+		}
+
+		for _, layer := range copied.Layers {
+			if layer.Status == LayerSent {
+				res.Layers++
+			}
+		}
+
+		present[id] = true
+	}
+
+	if !prune {
+		return res, nil
+	}
+
+	cs, ok := to.store.(conditionalStore)
+	if !ok && !dryRun {
+		return res, ErrUnconditionalRemote
+	}
+
+	for _, ref := range sortedRefs(have) {
+		if _, ok := want[ref]; ok {
+			continue
+		}
+
+		if dryRun {
+			res.Deleted = append(res.Deleted, ref)
+			continue
+		}
+
+		// only if it still names the image it was listed as naming, and
+		// hasn't been written since it was read
+		repo, tag := toRepositoryAndTag(ref)
+		name := fmt.Sprintf("%s%s/%s", imageSearchPrefix, repo, tag)
+		b, etag, err := cs.getBlobETag(name)
+		if err == ErrBlobNotFound {
+			continue
+		} else if err != nil {
+			return res, err
+		}
+
+		if refID(string(b)) == have[ref] {
+			err = cs.deleteBlobIfMatch(name, etag)
+		} else {
+			err = errPreconditionFailed
+		}
+
+		if err == errPreconditionFailed {
+			res.Kept = append(res.Kept, ref)
+			log.WithFields(log.Fields{
+				"repository": repo,
+				"tag":        tag,
+			}).Warn("kept tag that changed while syncing")
+			continue
+		} else if err != nil {
+			return res, err
+		}
+
+		res.Deleted = append(res.Deleted, ref)
+		log.WithFields(log.Fields{
+			"image id":   string(have[ref]),
+			"repository": repo,
+			"tag":        tag,
+		}).Info("deleted tag")
+	}
+
+	return res, nil
+}
+
+// Returns the image each tag refers to, as "{repository}:{tag}", for the
+// repositories matching any of the patterns (or all of them)
+func (l *layout) syncedRefs(patterns []string) (map[string]ID, error) {
+	refs, err := l.Images()
+	if err != nil {
+		return nil, err
+	}
+
+	coll := make(map[string]ID)
+	for _, ref := range refs {
+		if matchesAny(patterns, ref.Repository) {
+			coll[fmt.Sprintf("%s:%s", ref.Repository, ref.Tag)] = ref.Id
+		}
+	}
+
+	return coll, nil
+}
+
+func sortedRefs(refs map[string]ID) []string {
+	var names []string
+	for name := range refs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Returns whether a repository matches any of the patterns; any repository
+// does if there are none
+func matchesAny(patterns []string, repository string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, repository); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,61 @@
+package azdockertool
+
+import (
+	"reflect"
+	"testing"
+)
+
+// readHookStore is a filesystem remote that runs a func, once, as it's first
+// asked to read a given blob with its ETag, and before it does
+type readHookStore struct {
+	*FilesystemRemote
+	hooks map[string]func()
+}
+
+func (s *readHookStore) getBlobETag(name string) ([]byte, string, error) {
+	if hook, ok := s.hooks[name]; ok {
+		delete(s.hooks, name)
+		hook()
+	}
+
+	return s.FilesystemRemote.getBlobETag(name)
+}
+
+func TestSyncPruneKeepsTagsMovedMeanwhile(t *testing.T) {
+	src, cleanup := newTestRemote(t, Config{})
+	defer cleanup()
+
+	dst, cleanup := newTestRemote(t, Config{})
+	defer cleanup()
+
+	pushSave(t, src, "team/app:v2", "base", "v2")
+	pushSave(t, dst, "team/app:v1", "base", "v1")
+	v2 := pushSave(t, dst, "team/app:v2", "base", "v2")
+
+	// someone points the stale tag at v2 once the sync has listed it
+	fr := dst.(*FilesystemRemote)
+	fr.layout = &layout{fr.config, &readHookStore{fr, map[string]func(){
+		"refs/team/app/v1": func() {
+			writeFiles(t, fr.root, map[string]string{"refs/team/app/v1": v2.String()})
+		},
+	}}}
+
+	res, err := src.Sync(dst, nil, true, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(res.Deleted) != 0 || !reflect.DeepEqual(res.Kept, []string{"team/app:v1"}) {
+		t.Errorf("deleted %v and kept %v, expected to keep team/app:v1", res.Deleted, res.Kept)
+	}
+
+	if id, err := fr.readRef("refs/team/app/v1"); err != nil || id != v2 {
+		t.Errorf("expected team/app:v1 to name image %s, got %s, %v", v2.Short(), id.Short(), err)
+	}
+
+	// as it is now, it goes
+	res, err = src.Sync(dst, nil, true, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res.Deleted, []string{"team/app:v1"}) || len(res.Kept) != 0 {
+		t.Errorf("deleted %v and kept %v, expected to delete team/app:v1", res.Deleted, res.Kept)
+	}
+}
@@ -0,0 +1,181 @@
+package azdockertool
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+)
+
+var (
+	ErrIncompleteImage     error = errors.New("image has no manifest.json; it may be incomplete, or still being pushed")
+	ErrUnconditionalRemote error = errors.New("remote can't update tags conditionally")
+)
+
+// TagConflictError is returned when a tag isn't moved because it doesn't name
+// the image expected, or because it names another image already and
+// Config.NoClobber is set, or because it changed in the meantime
+type TagConflictError struct {
+	Repository string
+	Tag        string
+	Expected   ID // the (partial) image ID the tag was expected to name, if any
+	Actual     ID // the image the tag names; empty if it doesn't exist
+}
+
+func (e *TagConflictError) Error() string {
+	ref := fmt.Sprintf("%s:%s", e.Repository, e.Tag)
+	if e.Expected != "" && e.Actual == "" {
+		return fmt.Sprintf("tag '%s' doesn't exist; expected it to name image '%s'", ref, e.Expected.Short())
+	} else if e.Expected != "" {
+		return fmt.Sprintf("tag '%s' names image '%s', not '%s'", ref, e.Actual.Short(), e.Expected.Short())
+	} else if e.Actual == "" {
+		return fmt.Sprintf("tag '%s' was created by someone else", ref)
+	}
+
+	return fmt.Sprintf("tag '%s' already names image '%s'", ref, e.Actual.Short())
+}
+
+// Tags an image already in the remote, given a tag or (partial) image ID, as
+// repository:tag, without pushing it again; if expect is given, only if the
+// tag names that (partial) image ID now. Tagging an image without a
+// manifest.json is refused, since nothing could pull it.
+func (l *layout) Tag(query, tag string, expect ID) (ID, error) {
+	if err := l.checkPermissions("tag", "rlw"); err != nil {
+		return "", err
+	}
+
+	id, _, _, err := l.resolveImage(query)
+	if err != nil {
+		return "", err
+	}
+
+	refs, err := l.readRefs(id, []string{tag}, expect)
+	if err != nil {
+		return "", err
+	}
+
+	ok, err := l.hasBlob(fmt.Sprintf("images/%s/manifest.json", id))
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return "", ErrIncompleteImage
+	}
+
+	return id, l.putRefs(id, refs, expect)
+}
+
+// refUpdate is a tag an operation is to point at an image, as it was when the
+// operation read it
+type refUpdate struct {
+	repo    string
+	tag     string
+	current ID     // the image it named; empty if it didn't exist
+	etag    string // that it had; empty if it didn't exist
+}
+
+// Reads the tags an operation is to point at an image, and checks they may be,
+// so that one bound to conflict fails before it's sent anything. putRefs then
+// writes each only if it's still as it was read here.
+func (l *layout) readRefs(id ID, repoTags []string, expect ID) ([]*refUpdate, error) {
+	cs, ok := l.store.(conditionalStore)
+	if !ok {
+		return nil, ErrUnconditionalRemote
+	}
+
+	var refs []*refUpdate
+	for _, item := range repoTags {
+		repo, tag := toRepositoryAndTag(item)
+		if !validRefName(repo, tag) {
+			return nil, fmt.Errorf("invalid tag '%s'", item)
+		}
+
+		b, etag, err := cs.getBlobETag(fmt.Sprintf("%s%s/%s", imageSearchPrefix, repo, tag))
+		if err != nil && err != ErrBlobNotFound {
+			return nil, err
+		}
+
+		ref := &refUpdate{repo: repo, tag: tag, current: refID(string(b)), etag: etag}
+		if err := l.checkRef(ref, id, expect); err != nil {
+			return nil, err
+		}
+
+		refs = append(refs, ref)
+	}
+
+	return refs, nil
+}
+
+// Points tags read by readRefs at an image, each only if it hasn't changed
+// since (If-Match, or If-None-Match if it didn't exist), so that of two
+// writers racing for a tag, one gets a TagConflictError instead of silently
+// losing. A tag already naming the image is left as it is.
+func (l *layout) putRefs(id ID, refs []*refUpdate, expect ID) error {
+	cs := l.store.(conditionalStore)
+
+	for _, ref := range refs {
+		err := l.putRef(cs, id, ref, expect)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"image id":   id.String(),
+				"repository": ref.repo,
+				"tag":        ref.tag,
+				"rollback":   false,
+			}).Error("failed to set tag")
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"image id":   id.String(),
+			"repository": ref.repo,
+			"tag":        ref.tag,
+		}).Info("published tag")
+	}
+
+	return nil
+}
+
+func (l *layout) putRef(cs conditionalStore, id ID, ref *refUpdate, expect ID) error {
+	if ref.current == id {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s%s/%s", imageSearchPrefix, ref.repo, ref.tag)
+	err := cs.putBlobIfMatch(name, []byte(id), ref.etag)
+	if err == errPreconditionFailed {
+		// as when a retried write had already gone through
+		actual, _ := l.findLayerByImageAndTag(ref.repo, ref.tag)
+		if actual == id {
+			return nil
+		}
+
+		return &TagConflictError{Repository: ref.repo, Tag: ref.tag, Expected: expect, Actual: actual}
+	}
+
+	return err
+}
+
+// Returns a TagConflictError if a tag as read isn't to be pointed at id
+func (l *layout) checkRef(ref *refUpdate, id, expect ID) error {
+	conflict := expect != "" && (ref.current == "" || !strings.HasPrefix(ref.current.String(), expect.String()))
+	if expect == "" && l.config.NoClobber && ref.current != "" && ref.current != id {
+		conflict = true
+	}
+
+	if conflict {
+		return &TagConflictError{Repository: ref.repo, Tag: ref.tag, Expected: expect, Actual: ref.current}
+	}
+
+	return nil
+}
+
+// Whether refs/{repo}/{tag} names a tag, rather than somewhere else in the
+// remote: no part of it may be empty, "." or ".."
+func validRefName(repo, tag string) bool {
+	for _, part := range append(strings.Split(repo, "/"), tag) {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return !strings.Contains(tag, "/")
+}
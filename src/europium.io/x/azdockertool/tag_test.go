@@ -0,0 +1,74 @@
+package azdockertool
+
+import (
+	"testing"
+)
+
+func TestTagLosingARaceIsAConflict(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{Layout: LayoutLegacy, Compression: CompressionNone})
+	defer cleanup()
+
+	mine := pushSave(t, remote, "team/app:mine", "mine")
+	theirs := pushSave(t, remote, "team/app:theirs", "theirs")
+	pushSave(t, remote, "team/app:v1", "old")
+
+	// another writer moves the tag after this one has read it
+	fr := remote.(*FilesystemRemote)
+	refs, err := fr.readRefs(mine, []string{"team/app:v1"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := remote.Tag("team/app:theirs", "team/app:v1", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	err = fr.putRefs(mine, refs, "")
+	if conflict, ok := err.(*TagConflictError); !ok || conflict.Actual != theirs {
+		t.Fatalf("expected a TagConflictError naming %s, got %v", theirs.Short(), err)
+	}
+
+	if actual, _ := fr.readRef("refs/team/app/v1"); actual != theirs {
+		t.Errorf("team/app:v1 names %s, expected the winner %s", actual.Short(), theirs.Short())
+	}
+
+	// as does a tag created in the meantime
+	refs, err = fr.readRefs(mine, []string{"team/app:v2"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := remote.Tag("team/app:theirs", "team/app:v2", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err, ok := fr.putRefs(mine, refs, "").(*TagConflictError); !ok {
+		t.Errorf("expected a TagConflictError for a tag created meanwhile, got %v", err)
+	}
+}
+
+func TestTagExpectsTheImageGiven(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{Layout: LayoutLegacy, Compression: CompressionNone})
+	defer cleanup()
+
+	old := pushSave(t, remote, "team/app:v1", "old")
+	next := pushSave(t, remote, "team/app:next", "next")
+
+	_, err := remote.Tag("team/app:next", "team/app:v1", next[:12])
+	if conflict, ok := err.(*TagConflictError); !ok || conflict.Actual != old || conflict.Expected != next[:12] {
+		t.Fatalf("expected a TagConflictError naming %s, got %v", old.Short(), err)
+	}
+
+	if _, err := remote.Tag("team/app:next", "team/app:v2", old[:12]); err == nil {
+		t.Error("tagged team/app:v2, which doesn't exist, expecting it to name an image")
+	}
+
+	if _, err := remote.Tag("team/app:next", "team/app:v1", old[:12]); err != nil {
+		t.Fatalf("could not move team/app:v1 from the image expected: %v", err)
+	}
+
+	// the expectation is the invocation's own; the next one moves it freely
+	if _, err := remote.Tag("team/app:v1", "team/app:latest", ""); err != nil {
+		t.Errorf("could not tag without an expectation: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package azdockertool
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"strings"
+)
+
+var (
+	ErrNoSuchUpload      error = errors.New("no such upload")
+	ErrUnsupportedDigest error = errors.New("unsupported digest")
+)
+
+const (
+	// blobs uploaded over the registry API, by digest, until a manifest says
+	// what they are
+	uploadedSearchPrefix string = uploadSearchPrefix + "sha256/"
+)
+
+// RegistryUploads are the blobs `docker push` sends the registry API before
+// the manifest that names them. An upload session is a run of chunks,
+// uploads/{uuid}/{offset}, appended one request at a time; once finished it
+// becomes uploads/sha256/{digest}. All of it is left to gc to sweep up.
+type RegistryUploads struct {
+	layout *layout
+}
+
+func (l *layout) RegistryUploads() *RegistryUploads {
+	return &RegistryUploads{layout: l}
+}
+
+// Starts an upload session, returning its UUID
+func (u *RegistryUploads) Start() (string, error) {
+	if err := u.layout.checkPermissions("push", "rlw"); err != nil {
+		return "", err
+	}
+
+	uuid, err := newUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	// marks the session as started, however little is sent to it
+	if _, err := u.layout.putBlobFromReader(uploadChunkName(uuid, 0), strings.NewReader(""), ""); err != nil {
+		return "", err
+	}
+
+	return uuid, nil
+}
+
+// Returns how much has been sent to an upload session so far
+func (u *RegistryUploads) Size(uuid string) (int64, error) {
+	chunks, err := u.chunks(uuid)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	for _, item := range chunks {
+		size += item.Size
+	}
+
+	return size, nil
+}
+
+// Appends a chunk to an upload session, returning how much it now holds
+func (u *RegistryUploads) Append(uuid string, r io.Reader) (int64, error) {
+	size, err := u.Size(uuid)
+	if err != nil {
+		return 0, err
+	}
+
+	name := uploadChunkName(uuid, size)
+	if _, err := u.layout.putBlobFromReader(name, r, ""); err != nil {
+		return 0, err
+	}
+
+	item, err := u.layout.statBlob(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return size + item.Size, nil
+}
+
+// Ends an upload session, keeping what was sent as the blob with the given
+// digest; ErrDigestMismatch if it isn't. A single chunk, as `docker push`
+// sends, is copied (server-side, where the store can), once its digest is
+// known; otherwise the chunks are streamed into one blob.
+func (u *RegistryUploads) Finish(uuid, digest string) error {
+	dst, err := uploadedBlobPath(digest)
+	if err != nil {
+		return err
+	}
+
+	chunks, err := u.chunks(uuid)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, item := range chunks {
+		if item.Size > 0 {
+			names = append(names, item.Name)
+		}
+	}
+
+	exists, err := u.layout.hasBlob(dst)
+	if err != nil {
+		return err
+	}
+
+	if !exists && len(names) == 1 {
+		stored, err := u.layout.storedDigest(names[0])
+		if err != nil {
+			return err
+		} else if err := checkDigest(names[0], digest, stored); err != nil {
+			return err
+		}
+
+		if err := u.layout.duplicateBlob(names[0], dst); err != nil {
+			return err
+		}
+	} else if !exists {
+		r := &chunkReader{layout: u.layout, names: names}
+		_, err := u.layout.putBlobFromReader(dst, r, digest)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	u.deleteChunks(chunks)
+	return nil
+}
+
+// Abandons an upload session
+func (u *RegistryUploads) Cancel(uuid string) error {
+	chunks, err := u.chunks(uuid)
+	if err != nil {
+		return err
+	}
+
+	u.deleteChunks(chunks)
+	return nil
+}
+
+// Uploads a whole blob at once, which is kept only if it matches its digest
+func (u *RegistryUploads) Put(digest string, r io.Reader) error {
+	if err := u.layout.checkPermissions("push", "rlw"); err != nil {
+		return err
+	}
+
+	name, err := uploadedBlobPath(digest)
+	if err != nil {
+		return err
+	}
+
+	_, err = u.layout.putBlobFromReader(name, r, digest)
+	return err
+}
+
+// Returns the size of an uploaded blob; ErrBlobNotFound if there's none
+func (u *RegistryUploads) Stat(digest string) (int64, error) {
+	name, err := uploadedBlobPath(digest)
+	if err != nil {
+		return 0, err
+	}
+
+	item, err := u.layout.statBlob(name)
+	return item.Size, err
+}
+
+// Opens an uploaded blob, checking it against its digest as it's read
+func (u *RegistryUploads) Open(digest string) (io.ReadCloser, error) {
+	name, err := uploadedBlobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := u.layout.statBlob(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.layout.openVerified(item, digest)
+}
+
+// Lists the chunks of an upload session, in order; ErrNoSuchUpload if it
+// hasn't been started, or has ended
+func (u *RegistryUploads) chunks(uuid string) ([]blobInfo, error) {
+	if b, err := hex.DecodeString(uuid); err != nil || len(b) != 16 {
+		return nil, ErrNoSuchUpload
+	}
+
+	chunks, err := u.layout.store.listBlobs(fmt.Sprintf("%s%s/", uploadSearchPrefix, uuid))
+	if err != nil {
+		return nil, err
+	} else if len(chunks) == 0 {
+		return nil, ErrNoSuchUpload
+	}
+
+	return chunks, nil
+}
+
+// Deletes the chunks of an upload session; any left behind are gc's to sweep
+func (u *RegistryUploads) deleteChunks(chunks []blobInfo) {
+	for _, item := range chunks {
+		if err := u.layout.store.deleteBlob(item.Name); err != nil {
+			log.WithFields(log.Fields{
+				"path":   item.Name,
+				"reason": err.Error(),
+			}).Warn("failed to delete upload chunk")
+		}
+	}
+}
+
+// Returns a random upload ID
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Returns the name of the chunk of an upload session starting at offset;
+// padded, so that listing the session lists its chunks in order
+func uploadChunkName(uuid string, offset int64) string {
+	return fmt.Sprintf("%s%s/%020d", uploadSearchPrefix, uuid, offset)
+}
+
+// Returns the name of an uploaded blob, given its digest
+func uploadedBlobPath(digest string) (string, error) {
+	hash := strings.TrimPrefix(digest, "sha256:")
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 || hash == digest {
+		return "", ErrUnsupportedDigest
+	}
+
+	return uploadedSearchPrefix + hash, nil
+}
+
+// chunkReader reads the chunks of an upload session one after another,
+// opening each only once the last is done
+type chunkReader struct {
+	layout *layout
+	names  []string
+	cur    io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.names) == 0 {
+				return 0, io.EOF
+			}
+
+			f, err := c.layout.store.openBlob(c.names[0])
+			if err != nil {
+				return 0, err
+			}
+
+			c.cur, c.names = f, c.names[1:]
+		}
+
+		n, err := c.cur.Read(p)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.cur == nil {
+		return nil
+	}
+
+	return c.cur.Close()
+}
@@ -0,0 +1,394 @@
+package azdockertool
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	ProblemDanglingRef     = "dangling ref"     // tag points at an image that isn't there
+	ProblemUnreadableRef   = "unreadable ref"   // tag couldn't be read
+	ProblemBadManifest     = "bad manifest"     // manifest.json couldn't be read
+	ProblemIncompleteImage = "incomplete image" // config or repositories missing
+	ProblemMissingLayer    = "missing layer"    // manifest names a layer (or layer blob) that isn't there
+	ProblemIncompleteLayer = "incomplete layer" // layer lacks VERSION, json or layer.tar
+	ProblemDigestMismatch  = "digest mismatch"  // contents don't hash to what the config says (--deep)
+)
+
+var (
+	imageFiles    = []string{"manifest.json", "json", "repositories"}
+	casImageFiles = []string{"manifest.json"} // the rest is in blobs/sha256/
+	layerFiles    = []string{"VERSION", "json", "layer.tar"}
+)
+
+// Audits the remote, reporting:
+//
+// - tags that can't be read, or point at images without a manifest
+// - images whose manifest, config or repositories file is missing or unreadable
+// - layers named by a manifest that are missing or incomplete
+// - content addressed images whose config or layer blobs are missing
+//
+// With deep, every image config is re-hashed against its image ID, and every
+// layer.tar against the diff_id its image config gives it. With repair,
+// dangling tags are deleted, each only if it hasn't changed since it was
+// read; nothing else is touched.
+func (l *layout) Verify(deep, repair bool) (*VerifyResult, error) {
+	perms := "rl"
+	if repair {
+		perms += "d"
+	}
+
+	if err := l.checkPermissions("verify", perms); err != nil {
+		return nil, err
+	}
+
+	res := &VerifyResult{}
+
+	cs, conditional := l.store.(conditionalStore)
+	if repair && !conditional {
+		return nil, ErrUnconditionalRemote
+	}
+
+	// tags are read before images are listed: a push writes an image's
+	// manifest before it tags the image, so an image tagged by the time its
+	// tag is read has its manifest listed
+	refs, err := l.store.listBlobs(imageSearchPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var tagged []*listedRef
+	for _, item := range refs {
+		ref := &listedRef{name: item.Name}
+		if conditional {
+			var b []byte
+			b, ref.etag, err = cs.getBlobETag(item.Name)
+			ref.id = refID(string(b))
+		} else {
+			ref.id, err = l.readRef(item.Name)
+		}
+
+		if err == ErrBlobNotFound {
+			continue // deleted since
+		}
+
+		res.Refs++
+		if err != nil {
+			res.problem(ProblemUnreadableRef, item.Name, err.Error())
+			continue
+		}
+
+		tagged = append(tagged, ref)
+	}
+
+	images, err := l.listObjects(manifestSearchPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := l.listObjects(layerSearchPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := l.listBlobNames(blobSearchPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := make(map[string]bool)
+	for _, name := range names {
+		blobs[name] = true
+	}
+
+	// every tag should point at an image with a manifest
+	for _, ref := range tagged {
+		if images[ref.id]["manifest.json"] {
+			continue
+		}
+
+		p := res.problem(ProblemDanglingRef, ref.name, fmt.Sprintf("image '%s' has no manifest", ref.id.Short()))
+		if !repair {
+			continue
+		}
+
+		// only as it was read; one moved since may name an image pushed since
+		err := cs.deleteBlobIfMatch(ref.name, ref.etag)
+		if err == errPreconditionFailed {
+			log.WithFields(log.Fields{
+				"path": ref.name,
+			}).Warn("left dangling ref that changed while verifying")
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		p.Repaired = true
+
+		log.WithFields(log.Fields{
+			"path": ref.name,
+		}).Info("deleted dangling ref")
+	}
+
+	// every image should be complete, and so should its layers
+	var deepChecks []deepCheck
+	checked := make(map[ID]bool)
+	queued := make(map[ID]bool)
+
+	for _, id := range sortedObjectIds(images) {
+		res.Images++
+
+		var m *manifest
+		var merr error
+		if images[id]["manifest.json"] {
+			m, merr = l.getManifest(fmt.Sprintf("images/%s/manifest.json", id))
+		}
+
+		required := imageFiles
+		if m != nil && m.cas != nil {
+			required = casImageFiles
+		}
+
+		for _, name := range required {
+			if !images[id][name] {
+				res.problem(ProblemIncompleteImage, fmt.Sprintf("images/%s/", id), fmt.Sprintf("missing %s", name))
+			}
+		}
+
+		if !images[id]["manifest.json"] {
+			continue
+		} else if merr != nil {
+			res.problem(ProblemBadManifest, fmt.Sprintf("images/%s/manifest.json", id), merr.Error())
+			continue
+		}
+
+		hasConfig := images[id]["json"]
+		if m.cas != nil {
+			hasConfig = blobs[m.configBlob()]
+			if !hasConfig {
+				res.problem(ProblemIncompleteImage, fmt.Sprintf("images/%s/", id), fmt.Sprintf("missing config %s", m.configBlob()))
+			}
+		}
+
+		for i, lid := range m.LayerIds() {
+			if checked[lid] {
+				continue
+			}
+
+			checked[lid] = true
+			res.Layers++
+
+			if m.cas != nil {
+				if !blobs[m.layerBlob(i)] {
+					res.problem(ProblemMissingLayer, m.layerBlob(i), fmt.Sprintf("needed by image '%s'", id.Short()))
+				}
+
+				continue
+			}
+
+			files, ok := layers[lid]
+			if !ok {
+				res.problem(ProblemMissingLayer, fmt.Sprintf("layers/%s/", lid), fmt.Sprintf("needed by image '%s'", id.Short()))
+				continue
+			}
+
+			for _, name := range layerFiles {
+				if !files[name] {
+					res.problem(ProblemIncompleteLayer, fmt.Sprintf("layers/%s/", lid), fmt.Sprintf("missing %s", name))
+				}
+			}
+		}
+
+		if deep && hasConfig {
+			deepChecks = append(deepChecks, l.deepChecks(res, id, m, layers, blobs, queued)...)
+		}
+	}
+
+	if deep {
+		if err := l.runDeepChecks(res, deepChecks); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// listedRef is a tag as Verify read it
+type listedRef struct {
+	name string
+	id   ID
+	etag string // empty if the remote can't delete conditionally
+}
+
+// deepCheck is a blob to re-hash, and the digest it should have
+type deepCheck struct {
+	name   string
+	digest string
+	codec  string // to decompress it with first, if any
+}
+
+// Returns the blobs of an image to re-hash: its config, and those of its
+// layer.tars that are there and haven't been queued by another image
+func (l *layout) deepChecks(res *VerifyResult, id ID, m *manifest, layers map[ID]map[string]bool, blobs map[string]bool, queued map[ID]bool) []deepCheck {
+	configPath := m.configBlob()
+	checks := []deepCheck{{configPath, imageDigest(id), ""}}
+
+	var config imageConfig
+	if err := l.getJSON(configPath, &config); err != nil {
+		res.problem(ProblemIncompleteImage, configPath, err.Error())
+		return nil
+	}
+
+	ids := m.LayerIds()
+	if len(ids) != len(config.RootFS.DiffIDs) {
+		res.problem(ProblemBadManifest, fmt.Sprintf("images/%s/manifest.json", id),
+			fmt.Sprintf("lists %d layers, but the config has %d", len(ids), len(config.RootFS.DiffIDs)))
+		return checks
+	}
+
+	for i, lid := range ids {
+		name := m.layerBlob(i)
+		present := layers[lid]["layer.tar"]
+		if m.cas != nil {
+			present = blobs[name]
+		}
+
+		if !present || queued[lid] {
+			continue
+		}
+
+		queued[lid] = true
+
+		// compressed layers are hashed as docker saved them
+		codec := ""
+		if m.cas != nil {
+			var err error
+			if codec, err = layerCodec(m.cas.Layers[i].MediaType); err != nil {
+				res.problem(ProblemBadManifest, fmt.Sprintf("images/%s/manifest.json", id), err.Error())
+				continue
+			}
+		} else if layers[lid]["json"] {
+			c, err := l.getLayerCompression(lid)
+			if err != nil {
+				res.problem(ProblemIncompleteLayer, fmt.Sprintf("layers/%s/json", lid), err.Error())
+				continue
+			} else if c != nil {
+				codec = c.Codec
+			}
+		}
+
+		checks = append(checks, deepCheck{name, config.RootFS.DiffIDs[i], codec})
+	}
+
+	return checks
+}
+
+// Re-hashes blobs, config.Concurrency at a time, reporting those that don't match
+func (l *layout) runDeepChecks(res *VerifyResult, checks []deepCheck) error {
+	var mu sync.Mutex
+
+	return forEachParallel(l.config.Concurrency, len(checks), func(i int, stop <-chan struct{}) error {
+		check := checks[i]
+
+		if l.config.Verbose {
+			log.WithFields(log.Fields{
+				"path": check.name,
+			}).Info("hashing")
+		}
+
+		actual, err := l.hashBlob(check.name, check.codec)
+		if err != nil && err != ErrCorruptCompression {
+			return fmt.Errorf("could not read '%s': %v", check.name, err)
+		} else if err == nil && actual == check.digest {
+			return nil
+		}
+
+		detail := fmt.Sprintf("expected %s, got %s", check.digest, actual)
+		if err != nil {
+			detail = err.Error()
+		}
+
+		mu.Lock()
+		res.problem(ProblemDigestMismatch, check.name, detail)
+		mu.Unlock()
+
+		return nil
+	})
+}
+
+// Returns the digest of a blob, decompressed with codec if given
+func (l *layout) hashBlob(name, codec string) (string, error) {
+	f, err := l.store.openBlob(name)
+	if err != nil {
+		return "", err
+	}
+
+	if codec != "" {
+		if f, err = decompressor(name, codec, f); err != nil {
+			return "", err
+		}
+	}
+
+	defer f.Close()
+
+	d := newDigestingReader(name, f, "")
+	if _, err := io.Copy(ioutil.Discard, d); err != nil {
+		return "", err
+	}
+
+	return d.Digest(), nil
+}
+
+// Lists every {prefix}{id}/{name} blob, as the names of each id's blobs
+func (l *layout) listObjects(prefix string) (map[ID]map[string]bool, error) {
+	blobs, err := l.store.listBlobs(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[ID]map[string]bool)
+	for _, item := range blobs {
+		id, name, ok := splitObjectPath(prefix, item.Name)
+		if !ok {
+			continue
+		}
+
+		if objects[id] == nil {
+			objects[id] = make(map[string]bool)
+		}
+
+		objects[id][name] = true
+	}
+
+	return objects, nil
+}
+
+func sortedObjectIds(objects map[ID]map[string]bool) []ID {
+	var ids []ID
+	for id := range objects {
+		ids = append(ids, id)
+	}
+
+	sortIds(ids)
+	return ids
+}
+
+// Records a problem, returning it so that it can be marked as repaired
+func (res *VerifyResult) problem(kind, name, detail string) *VerifyProblem {
+	res.Problems = append(res.Problems, &VerifyProblem{Kind: kind, Name: name, Detail: detail})
+	return res.Problems[len(res.Problems)-1]
+}
+
+// Returns whether any problem is left unrepaired
+func (res *VerifyResult) Failed() bool {
+	for _, p := range res.Problems {
+		if !p.Repaired {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,92 @@
+package azdockertool
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVerifyRepairKeepsTagsWrittenByOtherTools(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{})
+	defer cleanup()
+
+	id := pushSave(t, remote, "team/app:v1", "base", "top")
+
+	fr := remote.(*FilesystemRemote)
+	writeFiles(t, fr.root, map[string]string{
+		"refs/team/app/v2": fmt.Sprintf("sha256:%s\n", id),
+	})
+
+	res, err := remote.Verify(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range res.Problems {
+		t.Errorf("unexpected problem: %s %s: %s", p.Kind, p.Name, p.Detail)
+	}
+
+	if res.Refs != 2 {
+		t.Errorf("expected 2 refs checked, got %d", res.Refs)
+	}
+
+	if ok, err := fr.hasBlob("refs/team/app/v2"); err != nil || !ok {
+		t.Errorf("expected refs/team/app/v2 to survive repair, got %v, %v", ok, err)
+	}
+}
+
+// listHookStore is a filesystem remote that runs a func, once, as it's first
+// asked to list a given prefix, and before it does
+type listHookStore struct {
+	*FilesystemRemote
+	hooks map[string]func()
+}
+
+func (s *listHookStore) listBlobs(prefix string) ([]blobInfo, error) {
+	if hook, ok := s.hooks[prefix]; ok {
+		delete(s.hooks, prefix)
+		hook()
+	}
+
+	return s.FilesystemRemote.listBlobs(prefix)
+}
+
+func TestVerifyRepairSparesTagsWrittenMeanwhile(t *testing.T) {
+	remote, cleanup := newTestRemote(t, Config{})
+	defer cleanup()
+
+	id := pushSave(t, remote, "team/app:v1", "base")
+
+	fr := remote.(*FilesystemRemote)
+	writeFiles(t, fr.root, map[string]string{
+		"refs/team/app/v3": strings.Repeat("0", 64),
+	})
+
+	var pushed ID
+	fr.layout = &layout{fr.config, &listHookStore{fr, map[string]func(){
+		// a push finishing as the tags are listed
+		imageSearchPrefix: func() { pushed = pushSave(t, remote, "team/app:v2", "other") },
+
+		// and the dangling tag moved to an image that's there, once it's read
+		manifestSearchPrefix: func() {
+			writeFiles(t, fr.root, map[string]string{"refs/team/app/v3": id.String()})
+		},
+	}}}
+
+	res, err := remote.Verify(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range res.Problems {
+		if p.Repaired {
+			t.Errorf("repaired %s %s: %s", p.Kind, p.Name, p.Detail)
+		}
+	}
+
+	for tag, want := range map[string]ID{"v2": pushed, "v3": id} {
+		if actual, err := fr.readRef("refs/team/app/" + tag); err != nil || actual != want {
+			t.Errorf("expected team/app:%s to name image %s, got %s, %v", tag, want.Short(), actual.Short(), err)
+		}
+	}
+}